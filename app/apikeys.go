@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+	"github.com/showbaba/movies-api/data"
+	"github.com/showbaba/movies-api/utils"
+)
+
+// what an api key can be allowed to do, the routes each scope opens are set in policies
+const (
+	ScopeMoviesRead    = "movies:read"
+	ScopeCommentsWrite = "comments:write"
+	ScopeCacheAdmin    = "cache:admin"
+)
+
+const (
+	apiKeyPrefix = "mk_"
+	// how much of a key is kept in the clear to recognise it by
+	apiKeyVisiblePrefix = 10
+)
+
+const apiKeyContextKey contextKey = "api_key"
+
+// APIKeyFromContext is the api key a request was made with, nil when it wasn't made with one
+func APIKeyFromContext(ctx context.Context) *data.APIKey {
+	key, _ := ctx.Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+// newAPIKey makes up a key, it is only ever shown to whoever created it
+func newAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashAPIKey is what is stored for key, keys are random enough that a plain hash can't be reversed
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func hasScope(key *data.APIKey, scope string) bool {
+	for _, granted := range key.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var input CreateAPIKeyPayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return
+	}
+	validate := validator.New()
+	err := validate.Struct(input)
+	if err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return
+	}
+
+	secret, err := newAPIKey()
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	key := data.APIKey{
+		Name:    input.Name,
+		Prefix:  secret[:apiKeyVisiblePrefix],
+		KeyHash: hashAPIKey(secret),
+		Scopes:  input.Scopes,
+	}
+	if _, err := models.APIKeys.Insert(r.Context(), &key); err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "api key created, store it now as it won't be shown again",
+		Data:    map[string]interface{}{"api_key": key, "key": secret},
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func FetchAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	keys, err := models.APIKeys.List(r.Context())
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "fetch api keys successfully",
+		Data:    keys,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Dispatch400Error(w, "invalid api key id", nil)
+		return
+	}
+	key, err := models.APIKeys.Revoke(r.Context(), id)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	if key == nil {
+		utils.Dispatch404Error(w, fmt.Sprintf("api key with id %d not found", id), nil)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "api key revoked successfully",
+		Data:    key,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
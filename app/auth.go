@@ -0,0 +1,450 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/showbaba/movies-api/data"
+	"github.com/showbaba/movies-api/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+)
+
+var errAuthDisabled = errors.New("authentication is not configured, set JWT_SECRET")
+
+// compared against when a login names an unknown user, so both cases take as long
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+// tokenClaims are the claims of access and refresh tokens, the subject is the user id
+type tokenClaims struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Type     string `json:"typ"`
+	jwt.RegisteredClaims
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	// seconds until the access token expires
+	ExpiresIn int `json:"expires_in"`
+}
+
+// UserFromContext is the account a request was authenticated as, nil for anonymous requests
+func UserFromContext(ctx context.Context) *data.User {
+	user, _ := ctx.Value(userContextKey).(*data.User)
+	return user
+}
+
+// issueTokens signs a new access and refresh token for user, the refresh token is recorded so it can only be used once
+func issueTokens(ctx context.Context, user *data.User) (*TokenPair, error) {
+	config := GetConfig()
+	if config.JWTSecret == "" {
+		return nil, errAuthDisabled
+	}
+	now := time.Now()
+	sign := func(tokenType, id string, ttl time.Duration) (string, error) {
+		claims := tokenClaims{
+			Username: user.Username,
+			Role:     user.Role,
+			Type:     tokenType,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        id,
+				Subject:   strconv.Itoa(user.ID),
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			},
+		}
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.JWTSecret))
+	}
+	accessToken, err := sign(tokenTypeAccess, "", config.AccessTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	refreshID, err := newRefreshTokenID()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := sign(tokenTypeRefresh, refreshID, config.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	if err := models.RefreshTokens.Insert(ctx, refreshID, user.ID, now.Add(config.RefreshTokenTTL)); err != nil {
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(config.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// newRefreshTokenID makes up the id a refresh token is recorded under
+func newRefreshTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// parseToken checks the signature, expiry and type of token and returns the user it was issued to along with the id of
+// the token. the role of the user is the one it had when the token was issued
+func parseToken(token, tokenType string) (*data.User, string, error) {
+	secret := GetConfig().JWTSecret
+	if secret == "" {
+		return nil, "", errAuthDisabled
+	}
+	var claims tokenClaims
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, "", err
+	}
+	if claims.Type != tokenType {
+		return nil, "", fmt.Errorf("token is not a %s token", tokenType)
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid token subject")
+	}
+	// tokens issued before roles carry none, every account was a commenter then
+	if claims.Role == "" {
+		claims.Role = RoleCommenter
+	}
+	return &data.User{ID: id, Username: claims.Username, Role: claims.Role}, claims.ID, nil
+}
+
+// authenticate is middleware attaching the user of a bearer token, or the api key of an ApiKey authorization, to the request
+// context. requests without either go through anonymously while requests with a bad one are turned away
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if strings.HasPrefix(authorization, "ApiKey ") {
+			key, err := models.APIKeys.Use(r.Context(), hashAPIKey(strings.TrimPrefix(authorization, "ApiKey ")))
+			if err != nil {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.Header().Set("Content-Type", "application/json")
+				utils.DispatchServerError(w, err)
+				return
+			}
+			if key == nil {
+				rejectUnauthenticated(w, r, "ApiKey", "invalid or revoked api key")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey, key)))
+			return
+		}
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		user, _, err := parseToken(strings.TrimPrefix(authorization, "Bearer "), tokenTypeAccess)
+		if err != nil {
+			rejectUnauthenticated(w, r, `Bearer error="invalid_token"`, "invalid or expired token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	})
+}
+
+// rejectUnauthenticated answers 401 to a request with bad credentials. the answer goes through the rate limiter so bad
+// credentials count against the client ip, and guessing api keys or tokens is as limited as anything else
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request, challenge, msg string) {
+	rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("WWW-Authenticate", challenge)
+		utils.Dispatch401Error(w, msg, nil)
+	})).ServeHTTP(w, r)
+}
+
+// requireUser only lets authenticated requests through to f
+func requireUser(f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if UserFromContext(r.Context()) == nil {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			utils.Dispatch401Error(w, "authentication required", nil)
+			return
+		}
+		f(w, r)
+	}
+}
+
+func Register(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var input RegisterPayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return
+	}
+	validate := validator.New()
+	err := validate.Struct(input)
+	if err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return
+	}
+	if GetConfig().JWTSecret == "" {
+		utils.Dispatch501Error(w, errAuthDisabled.Error(), nil)
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	user := data.User{Username: input.Username, Role: RoleCommenter, PasswordHash: string(passwordHash)}
+	if _, err := models.Users.Insert(r.Context(), &user); err != nil {
+		if errors.Is(err, data.ErrUsernameTaken) {
+			utils.Dispatch409Error(w, err.Error(), nil)
+			return
+		}
+		utils.DispatchServerError(w, err)
+		return
+	}
+	tokens, err := issueTokens(r.Context(), &user)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "registered successfully",
+		Data:    map[string]interface{}{"user": user, "tokens": tokens},
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func Login(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var input LoginPayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return
+	}
+	validate := validator.New()
+	err := validate.Struct(input)
+	if err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return
+	}
+	if GetConfig().JWTSecret == "" {
+		utils.Dispatch501Error(w, errAuthDisabled.Error(), nil)
+		return
+	}
+
+	user, err := models.Users.GetByUsername(r.Context(), input.Username)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	passwordHash := dummyPasswordHash
+	if user != nil {
+		passwordHash = []byte(user.PasswordHash)
+	}
+	if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(input.Password)); err != nil || user == nil {
+		utils.Dispatch401Error(w, "invalid username or password", nil)
+		return
+	}
+	tokens, err := issueTokens(r.Context(), user)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "logged in successfully",
+		Data:    tokens,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var input RefreshTokenPayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return
+	}
+	validate := validator.New()
+	err := validate.Struct(input)
+	if err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return
+	}
+
+	claimed, tokenID, err := parseToken(input.RefreshToken, tokenTypeRefresh)
+	if err != nil {
+		if errors.Is(err, errAuthDisabled) {
+			utils.Dispatch501Error(w, err.Error(), nil)
+			return
+		}
+		utils.Dispatch401Error(w, "invalid or expired refresh token", nil)
+		return
+	}
+	// a refresh token is good for one refresh, the token it is exchanged for replaces it
+	used, err := models.RefreshTokens.Use(r.Context(), tokenID)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	if !used {
+		// a token used twice may have been stolen, so every session of the account has to sign in again
+		if _, err := models.RefreshTokens.RevokeAll(r.Context(), claimed.ID); err != nil {
+			utils.DispatchServerError(w, err)
+			return
+		}
+		utils.Dispatch401Error(w, "invalid or expired refresh token", nil)
+		return
+	}
+	// the account may have gone, or its role changed, since the token was issued
+	user, err := models.Users.GetByID(r.Context(), claimed.ID)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	if user == nil {
+		utils.Dispatch401Error(w, "invalid or expired refresh token", nil)
+		return
+	}
+	tokens, err := issueTokens(r.Context(), user)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "token refreshed successfully",
+		Data:    tokens,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func Logout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var input RefreshTokenPayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return
+	}
+	validate := validator.New()
+	err := validate.Struct(input)
+	if err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return
+	}
+
+	_, tokenID, err := parseToken(input.RefreshToken, tokenTypeRefresh)
+	if err != nil {
+		if errors.Is(err, errAuthDisabled) {
+			utils.Dispatch501Error(w, err.Error(), nil)
+			return
+		}
+		utils.Dispatch401Error(w, "invalid or expired refresh token", nil)
+		return
+	}
+	if err := models.RefreshTokens.Revoke(r.Context(), tokenID); err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "logged out successfully",
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func FetchCurrentUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	user, err := models.Users.GetByID(r.Context(), UserFromContext(r.Context()).ID)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	if user == nil {
+		utils.Dispatch404Error(w, "user not found", nil)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "fetch user successfully",
+		Data:    user,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
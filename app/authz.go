@@ -0,0 +1,190 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-playground/validator"
+	"github.com/gorilla/mux"
+	"github.com/showbaba/movies-api/utils"
+)
+
+// roles, each one can do everything the ones before it can
+const (
+	RoleReader    = "reader"
+	RoleCommenter = "commenter"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleReader:    0,
+	RoleCommenter: 1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// Policy says who can call a route
+type Policy struct {
+	// the lowest role allowed
+	Role string
+	// the scope an api key needs. api keys can call public (RoleReader) routes without a scope but nothing else
+	Scope string
+}
+
+// the policy of every route, by method and path template. App.Get, App.Post, App.Patch and App.Delete refuse to register a route without one
+var policies = map[string]Policy{
+	"GET /ping":                         {Role: RoleReader},
+	"GET /stats/coalescing":             {Role: RoleReader},
+	"POST /auth/register":               {Role: RoleReader},
+	"POST /auth/login":                  {Role: RoleReader},
+	"POST /auth/refresh":                {Role: RoleReader},
+	"POST /auth/logout":                 {Role: RoleReader},
+	"GET /auth/me":                      {Role: RoleReader},
+	"POST /movies/{movie_id}/comment":   {Role: RoleCommenter, Scope: ScopeCommentsWrite},
+	"GET /movies":                       {Role: RoleReader, Scope: ScopeMoviesRead},
+	"GET /movies/{movie_id}":            {Role: RoleReader, Scope: ScopeMoviesRead},
+	"GET /movies/{movie_id}/characters": {Role: RoleReader, Scope: ScopeMoviesRead},
+	"GET /movies/{movie_id}/comments":   {Role: RoleReader, Scope: ScopeMoviesRead},
+	"DELETE /cache/movies/{movie_id}":   {Role: RoleAdmin, Scope: ScopeCacheAdmin},
+	"GET /comments/{id}":                {Role: RoleReader, Scope: ScopeMoviesRead},
+	"PATCH /comments/{id}":              {Role: RoleCommenter, Scope: ScopeCommentsWrite},
+	"DELETE /comments/{id}":             {Role: RoleCommenter, Scope: ScopeCommentsWrite},
+	"POST /comments/{id}/reactions":     {Role: RoleCommenter, Scope: ScopeCommentsWrite},
+	"DELETE /comments/{id}/reactions":   {Role: RoleCommenter, Scope: ScopeCommentsWrite},
+	"POST /comments/{id}/flag":          {Role: RoleCommenter, Scope: ScopeCommentsWrite},
+	"GET /admin/comments":               {Role: RoleModerator},
+	"POST /admin/comments/{id}/approve": {Role: RoleModerator},
+	"POST /admin/comments/{id}/reject":  {Role: RoleModerator},
+	"GET /admin/api-keys":               {Role: RoleAdmin},
+	"POST /admin/api-keys":              {Role: RoleAdmin},
+	"DELETE /admin/api-keys/{id}":       {Role: RoleAdmin},
+	"PATCH /admin/users/{id}/role":      {Role: RoleAdmin},
+}
+
+// hasRole tells whether role is at least required
+func hasRole(role, required string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[required]
+}
+
+// requestRole is the role of whoever made r. the admin token makes anyone an admin, signed in users have the role of
+// their account and everyone else is a reader, or a commenter when anonymous comments are allowed
+func requestRole(r *http.Request) string {
+	if token := GetConfig().AdminToken; token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) == 1 {
+		return RoleAdmin
+	}
+	if user := UserFromContext(r.Context()); user != nil {
+		return user.Role
+	}
+	if GetConfig().AnonymousComments {
+		return RoleCommenter
+	}
+	return RoleReader
+}
+
+// authorize wraps the handler of the route method path with its policy, clients short of it get a 403
+// (a 401 when signing in might help)
+func authorize(method, path string, f func(w http.ResponseWriter, r *http.Request)) func(w http.ResponseWriter, r *http.Request) {
+	policy, ok := policies[method+" "+path]
+	if !ok {
+		panic(fmt.Sprintf("no authorization policy for %s %s", method, path))
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key := APIKeyFromContext(r.Context()); key != nil {
+			if (policy.Scope == "" && policy.Role != RoleReader) || (policy.Scope != "" && !hasScope(key, policy.Scope)) {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.Header().Set("Content-Type", "application/json")
+				if policy.Scope == "" {
+					utils.Dispatch403Error(w, "api keys can't do this", nil)
+					return
+				}
+				utils.Dispatch403Error(w, fmt.Sprintf("api key is missing the %s scope", policy.Scope), map[string]string{"scope": policy.Scope})
+				return
+			}
+			f(w, r)
+			return
+		}
+		if user := UserFromContext(r.Context()); user != nil && roleRanks[policy.Role] >= roleRanks[RoleModerator] {
+			// the role of a token is the one the user had when it was issued, privileged routes go by the current one
+			current, err := models.Users.GetByID(r.Context(), user.ID)
+			if err != nil || current == nil {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.Header().Set("Content-Type", "application/json")
+				if err != nil {
+					utils.DispatchServerError(w, err)
+					return
+				}
+				// the account is gone
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				utils.Dispatch401Error(w, "invalid or expired token", nil)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), userContextKey, current))
+		}
+		if role := requestRole(r); !hasRole(role, policy.Role) {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Content-Type", "application/json")
+			if UserFromContext(r.Context()) == nil && role != RoleAdmin {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				utils.Dispatch401Error(w, "authentication required", map[string]string{"role": policy.Role})
+				return
+			}
+			utils.Dispatch403Error(w, fmt.Sprintf("the %s role is required", policy.Role), map[string]string{"role": policy.Role})
+			return
+		}
+		f(w, r)
+	}
+}
+
+func SetUserRole(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.Dispatch400Error(w, "invalid user id", nil)
+		return
+	}
+	var input SetRolePayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return
+	}
+	validate := validator.New()
+	err = validate.Struct(input)
+	if err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return
+	}
+
+	user, err := models.Users.SetRole(r.Context(), id, input.Role)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	if user == nil {
+		utils.Dispatch404Error(w, fmt.Sprintf("user with id %d not found", id), nil)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "role updated successfully, it applies at once on moderator and admin routes and from the user's next token refresh everywhere else",
+		Data:    user,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
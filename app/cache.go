@@ -0,0 +1,52 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Cache is the key/value store the handlers keep movies and characters in. every call takes the context of whatever it
+// is done for, so a client that goes away cancels its pending calls
+type Cache interface {
+	// get the value stored under key, found is false when the key does not exist or has expired
+	Get(ctx context.Context, key string) (value []byte, found bool, err error)
+	// store value under key, a ttl of 0 means the key never expires
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// store value under key unless it already holds a value, stored is false when it did. atomic, so of several
+	// concurrent calls for a key only one stores its value
+	SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (stored bool, err error)
+	Delete(ctx context.Context, key string) error
+	// atomically increment the counter stored under key and return the new value
+	Incr(ctx context.Context, key string) (int64, error)
+}
+
+// where the last list of films fetched from the movie provider is cached
+const movieListCacheKey = "movies"
+
+// movieCacheKey is where the movie with the canonical id movieID is cached
+func movieCacheKey(movieID string) string {
+	return "movie:" + movieID
+}
+
+// characterCacheKey is where a character is cached, characters are shared between movies so only their url matters
+func characterCacheKey(characterURL string) string {
+	return "character:" + characterURL
+}
+
+// NewCache builds the cache selected by config.CacheBackend, redisClient is only used by the redis backend
+func NewCache(config Config, redisClient *redis.Client) (Cache, error) {
+	switch config.CacheBackend {
+	case "", "redis":
+		if redisClient == nil {
+			return nil, fmt.Errorf("redis cache backend requires a redis client")
+		}
+		return NewRedisCache(redisClient), nil
+	case "memory":
+		return NewMemoryCache(config.CacheSize), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", config.CacheBackend)
+	}
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultCacheSize = 10000
+
+// MemoryCache is an in-process LRU cache, it lets the api run as a single binary without redis.
+// counters created by Incr are never evicted, losing one would hand out ids that are already in use
+type MemoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	// most recently used entries are at the front
+	order *list.List
+}
+
+type memoryEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+	pinned    bool
+}
+
+func NewMemoryCache(capacity int) *MemoryCache {
+	if capacity < 1 {
+		capacity = defaultCacheSize
+	}
+	return &MemoryCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *MemoryCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.lookup(key)
+	if entry == nil {
+		return nil, false, nil
+	}
+	value := make([]byte, len(entry.value))
+	copy(value, entry.value)
+	return value, true, nil
+}
+
+func (c *MemoryCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stored := make([]byte, len(value))
+	copy(stored, value)
+	c.store(key, stored, ttl, false)
+	return nil
+}
+
+func (c *MemoryCache) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lookup(key) != nil {
+		return false, nil
+	}
+	stored := make([]byte, len(value))
+	copy(stored, value)
+	c.store(key, stored, ttl, false)
+	return true, nil
+}
+
+func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	return nil
+}
+
+func (c *MemoryCache) Incr(ctx context.Context, key string) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var counter int64
+	if entry := c.lookup(key); entry != nil {
+		var err error
+		if counter, err = strconv.ParseInt(string(entry.value), 10, 64); err != nil {
+			return 0, err
+		}
+	}
+	counter++
+	c.store(key, []byte(strconv.FormatInt(counter, 10)), 0, true)
+	return counter, nil
+}
+
+// lookup returns the live entry for key and marks it as recently used, expired entries are dropped
+func (c *MemoryCache) lookup(key string) *memoryEntry {
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*memoryEntry)
+	if !entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt) {
+		c.remove(element)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry
+}
+
+func (c *MemoryCache) store(key string, value []byte, ttl time.Duration, pinned bool) {
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*memoryEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		entry.pinned = entry.pinned || pinned
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&memoryEntry{key: key, value: value, expiresAt: expiresAt, pinned: pinned})
+	c.evict()
+}
+
+// evict drops the least recently used entries until the cache is back within capacity
+func (c *MemoryCache) evict() {
+	element := c.order.Back()
+	for len(c.entries) > c.capacity && element != nil {
+		previous := element.Prev()
+		if !element.Value.(*memoryEntry).pinned {
+			c.remove(element)
+		}
+		element = previous
+	}
+}
+
+func (c *MemoryCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*memoryEntry).key)
+}
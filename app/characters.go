@@ -0,0 +1,133 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var errCharacterNotFound = errors.New("character not found")
+
+// resolveCharacters looks up every character url through a pool of workers, the returned slice has the same order as characterURLs.
+// the first failed lookup cancels the rest of the work
+func resolveCharacters(ctx context.Context, characterURLs []string, workers int) ([]*Character, CacheStatus, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(characterURLs) {
+		workers = len(characterURLs)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg         sync.WaitGroup
+		once       sync.Once
+		firstErr   error
+		characters = make([]*Character, len(characterURLs))
+		statuses   = make([]CacheStatus, len(characterURLs))
+		jobs       = make(chan int)
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				character, status, err := loadCharacter(ctx, characterURLs[index])
+				if err != nil {
+					fail(err)
+					continue
+				}
+				characters[index] = character
+				statuses[index] = status
+			}
+		}()
+	}
+
+feed:
+	for index := range characterURLs {
+		select {
+		case jobs <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, "", firstErr
+	}
+	// the parent context may have been cancelled without any lookup failing, e.g the client went away
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	var status CacheStatus
+	for _, characterStatus := range statuses {
+		status = mergeCacheStatus(status, characterStatus)
+	}
+	return characters, status, nil
+}
+
+// loadCharacter reads a character from the cache, falling back to the movie provider. a stale character is served as is and refreshed in the background
+func loadCharacter(ctx context.Context, characterURL string) (*Character, CacheStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var character Character
+	key := characterCacheKey(characterURL)
+	found, stale, err := readCached(ctx, key, &character)
+	if err != nil {
+		return nil, "", err
+	}
+	if found {
+		if !stale {
+			return &character, CacheFresh, nil
+		}
+		revalidate(key, func(ctx context.Context) error {
+			_, err := fetchCharacter(ctx, key, characterURL)
+			return err
+		})
+		return &character, CacheStale, nil
+	}
+
+	fetched, err := fetchCharacter(ctx, key, characterURL)
+	if err != nil {
+		return nil, "", err
+	}
+	return fetched, CacheOrigin, nil
+}
+
+// fetchCharacter gets a character from the movie provider and caches it under key.
+// concurrent fetches of the same character share a single upstream call
+func fetchCharacter(ctx context.Context, key, characterURL string) (*Character, error) {
+	result, err := characterFetches.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		character, err := movieProvider.GetCharacter(ctx, characterURL)
+		if err != nil {
+			return nil, err
+		}
+		if character == nil {
+			return nil, fmt.Errorf("%w: %s", errCharacterNotFound, characterURL)
+		}
+		// cache character data
+		if err := writeCached(ctx, key, character, GetConfig().CharacterTTL); err != nil {
+			return nil, err
+		}
+		return *character, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	character := result.(Character)
+	return &character, nil
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP is the address of the client behind r. the peer address is used unless it is one of Config.TrustedProxies,
+// in which case the forwarding headers (Forwarded, or X-Forwarded-For when there is none) are walked from the nearest hop back,
+// skipping trusted proxies, so a client can't pass itself off as someone else by sending the headers itself
+func clientIP(r *http.Request) string {
+	peer := parseHostIP(r.RemoteAddr)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+	trusted := GetConfig().TrustedProxies
+	if !isTrustedProxy(peer, trusted) {
+		return peer.String()
+	}
+
+	hops := forwardedFor(r.Header)
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHostIP(hops[i])
+		// an obfuscated or garbled hop leaves the last proxy that could be trusted as the client
+		if hop == nil {
+			break
+		}
+		client = hop
+		if !isTrustedProxy(hop, trusted) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// forwardedFor lists the addresses in the Forwarded header (RFC 7239) or else the X-Forwarded-For header, furthest hop first
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					name, address, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(name, "for") {
+						hops = append(hops, strings.Trim(address, `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(address))
+		}
+	}
+	return hops
+}
+
+// parseHostIP reads an ip that may carry a port, IPv6 addresses with a port are bracketed ([::1]:80)
+func parseHostIP(address string) net.IP {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	return net.ParseIP(strings.Trim(address, "[]"))
+}
+
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies reads a list of CIDRs or single ips, skipping invalid entries
+func parseTrustedProxies(values []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				log.Printf("ignoring invalid trusted proxy %q", value)
+				continue
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			log.Printf("ignoring invalid trusted proxy %q", value)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// coalescer makes sure only one upstream call per key is in flight, concurrent callers for the same key share its result
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+	// requests that asked for a key
+	requests atomic.Int64
+	// calls that actually went upstream
+	upstreamCalls atomic.Int64
+	// requests that got their result from a call started by another request
+	shared atomic.Int64
+}
+
+// coalescedCall is an upstream call in flight along with the callers still waiting on it
+type coalescedCall struct {
+	done    chan struct{}
+	val     interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// CoalescingStats is a snapshot of a coalescer's counters
+type CoalescingStats struct {
+	Requests      int64 `json:"requests"`
+	UpstreamCalls int64 `json:"upstream_calls"`
+	Shared        int64 `json:"shared"`
+}
+
+var (
+	filmFetches      = &coalescer{}
+	characterFetches = &coalescer{}
+)
+
+// do runs fn once for every group of concurrent callers of key. each caller stops waiting when its own ctx is done,
+// while fn keeps running for the others with a context of its own, which is cancelled once every caller has stopped waiting
+func (c *coalescer) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	c.requests.Add(1)
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	call, joined := c.calls[key]
+	if !joined {
+		// not tied to any one caller since others may be waiting on it
+		callCtx, cancel := context.WithTimeout(context.Background(), upstreamCallTimeout(GetConfig()))
+		call = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+		c.calls[key] = call
+		c.upstreamCalls.Add(1)
+		go c.run(callCtx, key, call, fn)
+	}
+	call.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		if joined {
+			c.shared.Add(1)
+		}
+		return call.val, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// nobody wants the result anymore, the next caller starts a call of its own
+			call.cancel()
+			c.forget(key, call)
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *coalescer) run(ctx context.Context, key string, call *coalescedCall, fn func(ctx context.Context) (interface{}, error)) {
+	defer call.cancel()
+	call.val, call.err = fn(ctx)
+	c.mu.Lock()
+	c.forget(key, call)
+	c.mu.Unlock()
+	close(call.done)
+}
+
+// forget removes call from the calls in flight unless another call has taken its key already, c.mu must be held
+func (c *coalescer) forget(key string, call *coalescedCall) {
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+}
+
+func (c *coalescer) stats() CoalescingStats {
+	return CoalescingStats{
+		Requests:      c.requests.Load(),
+		UpstreamCalls: c.upstreamCalls.Load(),
+		Shared:        c.shared.Load(),
+	}
+}
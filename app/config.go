@@ -2,26 +2,100 @@ package app
 
 import (
 	"log"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
+const defaultSwapiURL = "https://swapi.dev/api"
+
+var defaultReactionEmojis = []string{"👍", "❤️", "😂", "😮", "😢", "😡"}
+
 var (
 	_config       *Config
 	ConfigFactory = defaultConfig
 )
 
 type Config struct {
-	Port                 string
-	DbHost               string
-	DbPort               int
-	DbUser               string
-	DbPassword           string
-	DbName               string
-	RedisURL 						 string
+	Port       string
+	DbHost     string
+	DbPort     int
+	DbUser     string
+	DbPassword string
+	DbName     string
+	RedisURL   string
+	SwapiURL   string
+	// how long a call to each dependency may take before it is abandoned and the request fails with a 504,
+	// a request that is cancelled by its client abandons its calls straight away
+	DbTimeout    time.Duration
+	RedisTimeout time.Duration
+	SwapiTimeout time.Duration
+	// how many times a failed SWAPI request is retried, and the wait before the first retry which doubles for every retry after it
+	SwapiRetries      int
+	SwapiRetryBackoff time.Duration
+	// how many failed SWAPI requests in a row stop calls to its host for SwapiBreakerCooldown, 0 never stops them
+	SwapiBreakerFailures int
+	SwapiBreakerCooldown time.Duration
+	// which MovieProvider backs the handlers, either "swapi" or "fixtures"
+	MovieProvider string
+	FixturesDir   string
+	// size of the worker pool used to resolve the characters of a movie
+	CharacterWorkers int
+	// which Cache backs the handlers, either "redis" or "memory"
+	CacheBackend string
+	// maximum number of entries held by the memory cache
+	CacheSize int
+	// which CommentRepository stores comments, "postgres", "sqlite" or "memory"
+	CommentStore string
+	// database file of the sqlite comment store
+	CommentStorePath string
+	// how long cached movies and characters are fresh for, 0 means they never go stale
+	MovieTTL     time.Duration
+	CharacterTTL time.Duration
+	// how long an entry is still served (and refreshed in the background) after its ttl, 0 keeps it until evicted
+	CacheStaleTTL time.Duration
+	// how many of the most recent comments are embedded in movie payloads
+	EmbeddedComments int
+	// how deep replies can be nested, a reply to a top level comment is 1 level deep
+	CommentMaxDepth int
+	// emojis comments can be reacted with, on top of upvote and downvote
+	ReactionEmojis []string
+	// whether new comments are published straight away or wait in the moderation queue
+	CommentAutoApprove bool
+	// how many users have to flag a comment before it is hidden for review
+	CommentFlagThreshold int
+	// requests sending it in X-Admin-Token act as an admin, disabled when empty
+	AdminToken string
+	// longest comment body accepted, never more than the 500 characters the column holds
+	CommentMaxLength int
+	// how many links a comment body can contain
+	CommentMaxLinks int
+	// words filtered out of comment bodies, either masked with asterisks or rejected depending on BannedWordsMode ("mask" or "reject")
+	BannedWords     []string
+	BannedWordsMode string
+	// how long the same body from the same client (their account, api key or address, see clientIdentity) is rejected as a
+	// duplicate, 0 turns the check off
+	CommentDuplicateWindow time.Duration
+	// token bucket limits by rate limit group, requests are counted per client ip or api key
+	RateLimits map[string]RateLimit
+	// proxies whose X-Forwarded-For and Forwarded headers are believed when working out the client ip, none by default
+	TrustedProxies []*net.IPNet
+	// how commenter addresses are stored, "raw", "hmac" (keyed with IPHashKey) or "truncated"
+	IPPrivacyMode string
+	IPHashKey     string
+	// how long raw addresses are kept before the retention job hashes or truncates them, 0 keeps them
+	IPRetention time.Duration
+	// key access and refresh tokens are signed with, accounts are disabled when empty
+	JWTSecret       string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// whether comments can be posted without signing in, they are then attributed to an author handle
+	AnonymousComments bool
 }
 
 func GetConfig() Config {
@@ -34,15 +108,160 @@ func GetConfig() Config {
 
 func defaultConfig() *Config {
 	dbPort, _ := strconv.Atoi(os.Getenv("DB_PORT"))
+	swapiRetries, err := strconv.Atoi(getEnv("SWAPI_RETRIES", "2"))
+	if err != nil || swapiRetries < 0 {
+		swapiRetries = 2
+	}
+	swapiBreakerFailures, err := strconv.Atoi(getEnv("SWAPI_BREAKER_FAILURES", "5"))
+	if err != nil || swapiBreakerFailures < 0 {
+		swapiBreakerFailures = 5
+	}
+	characterWorkers, err := strconv.Atoi(getEnv("CHARACTER_WORKERS", "8"))
+	if err != nil || characterWorkers < 1 {
+		characterWorkers = 8
+	}
+	cacheSize, _ := strconv.Atoi(getEnv("CACHE_SIZE", strconv.Itoa(defaultCacheSize)))
+	embeddedComments, err := strconv.Atoi(getEnv("EMBEDDED_COMMENTS", "10"))
+	if err != nil || embeddedComments < 0 {
+		embeddedComments = 10
+	}
+	commentMaxDepth, err := strconv.Atoi(getEnv("COMMENT_MAX_DEPTH", "5"))
+	if err != nil || commentMaxDepth < 0 {
+		commentMaxDepth = 5
+	}
+	commentAutoApprove, err := strconv.ParseBool(getEnv("COMMENT_AUTO_APPROVE", "true"))
+	if err != nil {
+		commentAutoApprove = true
+	}
+	commentFlagThreshold, err := strconv.Atoi(getEnv("COMMENT_FLAG_THRESHOLD", "3"))
+	if err != nil || commentFlagThreshold < 1 {
+		commentFlagThreshold = 3
+	}
+	commentMaxLength, err := strconv.Atoi(getEnv("COMMENT_MAX_LENGTH", strconv.Itoa(maxCommentLength)))
+	if err != nil || commentMaxLength < 1 || commentMaxLength > maxCommentLength {
+		commentMaxLength = maxCommentLength
+	}
+	anonymousComments, err := strconv.ParseBool(getEnv("ANONYMOUS_COMMENTS", "true"))
+	if err != nil {
+		anonymousComments = true
+	}
+	ipRetentionDays, err := strconv.Atoi(getEnv("IP_RETENTION_DAYS", "30"))
+	if err != nil || ipRetentionDays < 0 {
+		ipRetentionDays = 30
+	}
+	commentMaxLinks, err := strconv.Atoi(getEnv("COMMENT_MAX_LINKS", "2"))
+	if err != nil || commentMaxLinks < 0 {
+		commentMaxLinks = 2
+	}
 	return &Config{
-		Port:                 os.Getenv("PORT"),
-		DbHost:               os.Getenv("DB_HOST"),
-		DbPort:               dbPort,
-		DbUser:               os.Getenv("DB_USER"),
-		DbPassword:           os.Getenv("DB_PASSWORD"),
-		DbName:               os.Getenv("DB_NAME"),
-		RedisURL: 						os.Getenv("REDIS_URL"),
+		Port:                   os.Getenv("PORT"),
+		DbHost:                 os.Getenv("DB_HOST"),
+		DbPort:                 dbPort,
+		DbUser:                 os.Getenv("DB_USER"),
+		DbPassword:             os.Getenv("DB_PASSWORD"),
+		DbName:                 os.Getenv("DB_NAME"),
+		RedisURL:               os.Getenv("REDIS_URL"),
+		SwapiURL:               getEnv("SWAPI_URL", defaultSwapiURL),
+		DbTimeout:              getEnvDuration("DB_TIMEOUT", 3*time.Second),
+		RedisTimeout:           getEnvDuration("REDIS_TIMEOUT", 3*time.Second),
+		SwapiTimeout:           getEnvDuration("SWAPI_TIMEOUT", 10*time.Second),
+		SwapiRetries:           swapiRetries,
+		SwapiRetryBackoff:      getEnvDuration("SWAPI_RETRY_BACKOFF", 200*time.Millisecond),
+		SwapiBreakerFailures:   swapiBreakerFailures,
+		SwapiBreakerCooldown:   getEnvDuration("SWAPI_BREAKER_COOLDOWN", 30*time.Second),
+		MovieProvider:          getEnv("MOVIE_PROVIDER", "swapi"),
+		FixturesDir:            getEnv("FIXTURES_DIR", "fixtures"),
+		CharacterWorkers:       characterWorkers,
+		CacheBackend:           getEnv("CACHE_BACKEND", "redis"),
+		CacheSize:              cacheSize,
+		CommentStore:           getEnv("COMMENT_STORE", "postgres"),
+		CommentStorePath:       getEnv("COMMENT_STORE_PATH", "comments.db"),
+		MovieTTL:               getEnvDuration("MOVIE_TTL", 24*time.Hour),
+		CharacterTTL:           getEnvDuration("CHARACTER_TTL", 24*time.Hour),
+		CacheStaleTTL:          getEnvDuration("CACHE_STALE_TTL", 0),
+		EmbeddedComments:       embeddedComments,
+		CommentMaxDepth:        commentMaxDepth,
+		ReactionEmojis:         getEnvList("REACTION_EMOJIS", defaultReactionEmojis),
+		CommentAutoApprove:     commentAutoApprove,
+		CommentFlagThreshold:   commentFlagThreshold,
+		AdminToken:             os.Getenv("ADMIN_TOKEN"),
+		CommentMaxLength:       commentMaxLength,
+		CommentMaxLinks:        commentMaxLinks,
+		BannedWords:            getEnvList("BANNED_WORDS", nil),
+		BannedWordsMode:        getEnv("BANNED_WORDS_MODE", BannedWordsMask),
+		CommentDuplicateWindow: getEnvDuration("COMMENT_DUPLICATE_WINDOW", 10*time.Minute),
+		TrustedProxies:         parseTrustedProxies(getEnvList("TRUSTED_PROXIES", nil)),
+		IPPrivacyMode:          getEnv("IP_PRIVACY_MODE", "raw"),
+		IPHashKey:              os.Getenv("IP_HASH_KEY"),
+		IPRetention:            time.Duration(ipRetentionDays) * 24 * time.Hour,
+		// JWT_SCECRET is how .env.example used to spell it
+		JWTSecret:         getEnv("JWT_SECRET", os.Getenv("JWT_SCECRET")),
+		AccessTokenTTL:    getEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:   getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		AnonymousComments: anonymousComments,
+		RateLimits: map[string]RateLimit{
+			RateLimitComments: getEnvRateLimit("RATE_LIMIT_COMMENTS", RateLimit{Requests: 10, Per: time.Minute}),
+			RateLimitMovies:   getEnvRateLimit("RATE_LIMIT_MOVIES", RateLimit{Requests: 60, Per: time.Minute}),
+			RateLimitDefault:  getEnvRateLimit("RATE_LIMIT_DEFAULT", RateLimit{Requests: 300, Per: time.Minute}),
+		},
+	}
+}
+
+// getEnv returns the value of the environment variable key or fallback when it is not set
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getEnvDuration parses the environment variable key as a time.Duration (e.g 90s, 24h), falling back when it is unset or invalid
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(getEnv(key, fallback.String()))
+	if err != nil {
+		log.Printf("invalid duration for %s, using %s", key, fallback)
+		return fallback
+	}
+	return value
+}
+
+// getEnvList splits the comma separated environment variable key, falling back when it is unset
+func getEnvList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok || value == "" {
+		return fallback
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getEnvRateLimit parses the environment variable key as requests/period (e.g 10/1m), 0 turns the limit off
+func getEnvRateLimit(key string, fallback RateLimit) RateLimit {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	if value == "0" {
+		return RateLimit{}
+	}
+	requests, period, _ := strings.Cut(value, "/")
+	count, err := strconv.Atoi(requests)
+	if err != nil || count < 0 {
+		log.Printf("invalid rate limit for %s, using %d/%s", key, fallback.Requests, fallback.Per)
+		return fallback
+	}
+	per, err := time.ParseDuration(period)
+	// buckets are refilled by the millisecond
+	if err != nil || per < time.Millisecond {
+		log.Printf("invalid rate limit for %s, using %d/%s", key, fallback.Requests, fallback.Per)
+		return fallback
 	}
+	return RateLimit{Requests: count, Per: per}
 }
 
 func init() {
@@ -1,7 +1,9 @@
 package app
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -11,12 +13,16 @@ import (
 	"time"
 
 	"github.com/go-playground/validator"
-	"github.com/go-redis/redis"
 	"github.com/gorilla/mux"
 	"github.com/showbaba/movies-api/data"
 	"github.com/showbaba/movies-api/utils"
 )
 
+const (
+	defaultCommentPageSize = 20
+	maxCommentPageSize     = 100
+)
+
 func Ping(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
@@ -26,7 +32,49 @@ func Ping(w http.ResponseWriter, r *http.Request) {
 	}
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func FetchCoalescingStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "fetch coalescing stats successfully",
+		Data: map[string]CoalescingStats{
+			"films":      filmFetches.stats(),
+			"characters": characterFetches.stats(),
+		},
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+// EvictMovie drops the cached copy of a movie so the next request fetches it from the movie provider again
+func EvictMovie(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	movieID := mux.Vars(r)["movie_id"]
+	if err := movieCache.Delete(r.Context(), movieCacheKey(movieID)); err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "movie evicted from cache successfully",
+		Data:    map[string]string{"id": movieID},
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
 		return
 	}
 	w.Write(responseJSON)
@@ -55,167 +103,343 @@ func AddComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// check if movie with id exist in the redis db
-	var movie *Movie
-	movie, err = getMovieByIDFromRedis(redisClient, movieID)
+	movie, cacheStatus, err := loadMovie(r.Context(), movieID)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		dispatchUpstreamError(w, err)
 		return
 	}
 	if movie == nil {
-		// check the movies api
-		movie, err = getMovieByIDFromAPI(movieID)
-		if err != nil {
-			utils.Dispatch500Error(w, err)
-			return
-		}
-		if movie == nil {
-			utils.Dispatch404Error(w, "movie with id %s not found", err)
-			return
-		} else {
-			// cache movie
-			if err := cacheMovie(movieID, movie, redisClient); err != nil {
-				utils.Dispatch500Error(w, err)
-				return
-			}
-		}
+		utils.Dispatch404Error(w, fmt.Sprintf("movie with id %s not found", movieID), nil)
+		return
 	}
+	setCacheStatus(w, cacheStatus)
 
+	authorIP := clientIP(r)
 	// create comment with movie id
 	comment := data.Comment{
-		MovieID:      movieID,
+		MovieID:      movie.ID,
 		Body:         input.Body,
-		UserPublicIP: input.UserPublicIP,
+		AuthorHandle: ipPrivacy.Handle(authorIP),
+		AuthorKey:    ipPrivacy.AuthorKey(authorIP),
+		Status:       newCommentStatus(),
+	}
+	comment.UserPublicIP, comment.IPFormat = ipPrivacy.Protect(authorIP)
+	if user := UserFromContext(r.Context()); user != nil {
+		comment.UserID = &user.ID
+		comment.AuthorHandle = user.Username
+	}
+	draft := CommentDraft{Body: input.Body, Author: clientIdentity(r)}
+	if rejection := runCommentFilters(r.Context(), &draft); rejection != nil {
+		utils.Dispatch400Error(w, "validation error", rejection)
+		return
 	}
-	id, err := comment.Insert()
+	comment.Body = draft.Body
+	// the parent is checked, the reply written and its body recorded as one unit of work
+	var rejection string
+	var filterRejection *FilterRejection
+	recorded := false
+	err = models.Comments.WithTx(r.Context(), func(comments data.CommentRepository) error {
+		if input.ParentID != nil {
+			// replies have to stay on the same movie and within the depth limit
+			parent, err := comments.GetByID(r.Context(), *input.ParentID)
+			if err != nil {
+				return err
+			}
+			if parent == nil || parent.MovieID != movie.ID || parent.Status != data.StatusApproved {
+				rejection = fmt.Sprintf("comment with id %d not found on movie %s", *input.ParentID, movie.ID)
+				return nil
+			}
+			if parent.Depth+1 > GetConfig().CommentMaxDepth {
+				rejection = fmt.Sprintf("replies can't be nested more than %d levels deep", GetConfig().CommentMaxDepth)
+				return nil
+			}
+			comment.ParentID = &parent.ID
+			comment.Depth = parent.Depth + 1
+		}
+		if _, err := comments.Insert(r.Context(), &comment); err != nil {
+			return err
+		}
+		if filterRejection = recordComment(r.Context(), &draft); filterRejection != nil {
+			return errCommentRejected
+		}
+		recorded = true
+		return nil
+	})
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		if recorded {
+			// the comment was recorded but never stored
+			forgetComment(r.Context(), &draft, commentFilters)
+		}
+		if errors.Is(err, errCommentRejected) {
+			utils.Dispatch400Error(w, "validation error", filterRejection)
+			return
+		}
+		utils.DispatchServerError(w, err)
+		return
+	}
+	if rejection != "" {
+		utils.Dispatch400Error(w, rejection, nil)
 		return
 	}
+	message := "comment added successfully"
+	if comment.Status == data.StatusPending {
+		message = "comment submitted for review"
+	}
 	response := utils.APIResponse{
 		Status:  http.StatusOK,
-		Message: "comment added successfully",
-		Data:    map[string]string{"id": fmt.Sprint(id)},
+		Message: message,
+		Data:    map[string]string{"id": fmt.Sprint(comment.ID), "status": comment.Status},
 	}
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		utils.DispatchServerError(w, err)
 		return
 	}
 	w.Write(responseJSON)
 }
 
-func FetchMovies(w http.ResponseWriter, r *http.Request) {
+func FetchComment(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
-	resp, err := http.Get("https://swapi.dev/api/films/")
-	if err != nil {
-		utils.Dispatch500Error(w, err)
+	comment, ok := getApprovedCommentFromRequest(w, r)
+	if !ok {
+		return
 	}
-	defer resp.Body.Close()
-
-	var movieData struct {
-		Results []Movie `json:"results"`
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "fetch comment successfully",
+		Data:    comment,
 	}
-	err = json.NewDecoder(resp.Body).Decode(&movieData)
+	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		utils.DispatchServerError(w, err)
 		return
 	}
+	w.Write(responseJSON)
+}
 
-	movies := movieData.Results
+func UpdateComment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
 
-	// Sort movies by release date
-	sort.Slice(movies, func(i, j int) bool {
-		dateI, _ := time.Parse("2006-01-02", movies[i].ReleaseDate)
-		dateJ, _ := time.Parse("2006-01-02", movies[j].ReleaseDate)
-		return dateI.Before(dateJ)
-	})
+	var input UpdateCommentPayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return
+	}
+	validate := validator.New()
+	err := validate.Struct(input)
+	if err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return
+	}
 
-	var cachedMovies []Movie
+	comment, ok := getCommentFromRequest(w, r)
+	if !ok {
+		return
+	}
+	// only the author of a comment can change it
+	if !isCommentAuthor(r, comment) {
+		utils.Dispatch403Error(w, "only the author of a comment can edit it", nil)
+		return
+	}
 
-	for _, movie := range movies {
-		key := "movie_title:" + movie.Title
-		exists, err := redisClient.Exists(key).Result()
-		if err != nil {
-			utils.Dispatch500Error(w, err)
+	// an unchanged body already went through the filters when it was stored
+	filtered := input.Body != comment.Body
+	draft := CommentDraft{Body: input.Body, Author: clientIdentity(r)}
+	if filtered {
+		if rejection := runCommentFilters(r.Context(), &draft); rejection != nil {
+			utils.Dispatch400Error(w, "validation error", rejection)
 			return
 		}
-		if exists == 1 {
-			movieID, err := redisClient.Get(key).Result()
-			if err != nil {
-				if err == redis.Nil {
-					utils.Dispatch404Error(w, "movie with title %s not found", strings.Trim(key, "movie_title:"))
-					return
-				}
-				utils.Dispatch500Error(w, err)
-				return
-			}
-			movie, err := getMovieByIDFromRedis(redisClient, movieID)
-			if err != nil {
-				utils.Dispatch500Error(w, err)
-				return
-			}
-			// Fetch comments for the movie from PostgreSQL
-			comments, err := models.Comment.Fetch(movieID)
-			if err != nil {
-				utils.Dispatch500Error(w, err)
-				return
-			}
-			movie.Comments = comments
-			movie.CommentCount = len(comments)
-			cachedMovies = append(cachedMovies, *movie)
-			continue
+		comment.Body = draft.Body
+	}
+	// an edit has to be reviewed again when comments aren't published straight away
+	if comment.Status == data.StatusApproved {
+		comment.Status = newCommentStatus()
+	}
+	// the new body is recorded in the same unit of work as the update
+	var filterRejection *FilterRejection
+	recorded := false
+	err = models.Comments.WithTx(r.Context(), func(comments data.CommentRepository) error {
+		if err := comments.Update(r.Context(), comment); err != nil || !filtered {
+			return err
 		}
-
-		id, err := redisClient.Incr("movie_id_counter").Result()
-		if err != nil {
-			utils.Dispatch500Error(w, err)
-			return
+		if filterRejection = recordComment(r.Context(), &draft); filterRejection != nil {
+			return errCommentRejected
 		}
-		movie.ID = id
-
-		jsonData, err := json.Marshal(movie)
-		if err != nil {
-			utils.Dispatch500Error(w, err)
+		recorded = true
+		return nil
+	})
+	if err != nil {
+		if recorded {
+			forgetComment(r.Context(), &draft, commentFilters)
+		}
+		if errors.Is(err, errCommentRejected) {
+			utils.Dispatch400Error(w, "validation error", filterRejection)
 			return
 		}
-
-		err = redisClient.Set(strconv.Itoa(int(id)), jsonData, 0).Err()
-		if err != nil {
-			utils.Dispatch500Error(w, err)
+		// deleted since it was read
+		if errors.Is(err, data.ErrCommentNotFound) {
+			utils.Dispatch404Error(w, fmt.Sprintf("comment with id %d not found", comment.ID), nil)
 			return
 		}
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "comment updated successfully",
+		Data:    comment,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
 
-		// store the movie ID under the key "movie_title:{title}", this helps for faster lookup by title
-		err = redisClient.Set(key, id, 0).Err()
-		if err != nil {
-			utils.Dispatch500Error(w, err)
+func DeleteComment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	comment, ok := getCommentFromRequest(w, r)
+	if !ok {
+		return
+	}
+	// only the author of a comment can remove it
+	if !isCommentAuthor(r, comment) {
+		utils.Dispatch403Error(w, "only the author of a comment can delete it", nil)
+		return
+	}
+
+	if err := models.Comments.Delete(r.Context(), comment); err != nil {
+		// deleted since it was read
+		if errors.Is(err, data.ErrCommentNotFound) {
+			utils.Dispatch404Error(w, fmt.Sprintf("comment with id %d not found", comment.ID), nil)
 			return
 		}
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "comment deleted successfully",
+		Data:    map[string]string{"id": fmt.Sprint(comment.ID)},
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
 
-		// Fetch comments for the movie from PostgreSQL
-		comments, err := models.Comment.Fetch(strconv.FormatInt(id, 10))
-		if err != nil {
-			utils.Dispatch500Error(w, err)
+func AddReaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	input, ok := readReactionPayload(w, r)
+	if !ok {
+		return
+	}
+	comment, ok := getApprovedCommentFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := models.Comments.AddReaction(r.Context(), comment, clientIdentity(r), input.Reaction); err != nil {
+		// deleted since it was read
+		if errors.Is(err, data.ErrCommentNotFound) {
+			utils.Dispatch404Error(w, fmt.Sprintf("comment with id %d not found", comment.ID), nil)
 			return
 		}
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "reaction added successfully",
+		Data:    comment,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func RemoveReaction(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	input, ok := readReactionPayload(w, r)
+	if !ok {
+		return
+	}
+	comment, ok := getApprovedCommentFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := models.Comments.RemoveReaction(r.Context(), comment, clientIdentity(r), input.Reaction); err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "reaction removed successfully",
+		Data:    comment,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func FetchMovies(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
 
-		// Join comments to the movie object in Redis
-		movie.Comments = comments
-		movie.CommentCount = len(comments)
-		cachedMovies = append(cachedMovies, movie)
+	movies, cacheStatus, err := loadMovies(r.Context())
+	if err != nil {
+		dispatchUpstreamError(w, err)
+		return
+	}
+	setCacheStatus(w, cacheStatus)
+
+	// Sort movies by release date
+	sort.Slice(movies, func(i, j int) bool {
+		dateI, _ := time.Parse("2006-01-02", movies[i].ReleaseDate)
+		dateJ, _ := time.Parse("2006-01-02", movies[j].ReleaseDate)
+		return dateI.Before(dateJ)
+	})
+
+	// Join the comment counts and most recent comments to the movie objects
+	moviePointers := make([]*Movie, len(movies))
+	for i := range movies {
+		moviePointers[i] = &movies[i]
+	}
+	if err := attachComments(r.Context(), moviePointers...); err != nil {
+		utils.DispatchServerError(w, err)
+		return
 	}
 
 	response := utils.APIResponse{
 		Status:  http.StatusOK,
 		Message: "fetch movies successfully",
-		Data:    cachedMovies,
+		Data:    movies,
 	}
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		utils.DispatchServerError(w, err)
 		return
 	}
 	w.Write(responseJSON)
@@ -228,40 +452,21 @@ func FetchMovie(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	movieID := vars["movie_id"]
 
-	var err error
-
-	var movie *Movie
-	movie, err = getMovieByIDFromRedis(redisClient, movieID)
+	movie, cacheStatus, err := loadMovie(r.Context(), movieID)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		dispatchUpstreamError(w, err)
 		return
 	}
 	if movie == nil {
-		// check the movies api
-		movie, err = getMovieByIDFromAPI(movieID)
-		if err != nil {
-			utils.Dispatch500Error(w, err)
-			return
-		}
-		if movie == nil {
-			utils.Dispatch404Error(w, "movie with id %s not found", err)
-			return
-		} else {
-			// cache movie
-			if err := cacheMovie(movieID, movie, redisClient); err != nil {
-				utils.Dispatch500Error(w, err)
-				return
-			}
-		}
+		utils.Dispatch404Error(w, fmt.Sprintf("movie with id %s not found", movieID), nil)
+		return
 	}
-	// Fetch comments for the movie from PostgreSQL
-	comments, err := models.Comment.Fetch(movieID)
-	if err != nil {
-		utils.Dispatch500Error(w, err)
+	setCacheStatus(w, cacheStatus)
+	// Join the most recent comments to the movie object
+	if err := attachComments(r.Context(), movie); err != nil {
+		utils.DispatchServerError(w, err)
 		return
 	}
-	movie.Comments = comments
-	movie.CommentCount = len(comments)
 	response := utils.APIResponse{
 		Status:  http.StatusOK,
 		Message: "fetch movie successfully",
@@ -269,141 +474,142 @@ func FetchMovie(w http.ResponseWriter, r *http.Request) {
 	}
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		utils.DispatchServerError(w, err)
 		return
 	}
 	w.Write(responseJSON)
 }
 
-func FetchMovieCharacters(w http.ResponseWriter, r *http.Request) {
+func FetchMovieComments(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 
 	vars := mux.Vars(r)
 	movieID := vars["movie_id"]
-	queryParams := r.URL.Query()
-	sortBy := queryParams.Get("sort_by")
-	sortOrder := queryParams.Get("sort_order")
+	query, err := parseCommentPageQuery(r)
+	if err != nil {
+		utils.Dispatch400Error(w, err.Error(), nil)
+		return
+	}
 
-	var movie *Movie
-	var err error
-	movie, err = getMovieByIDFromRedis(redisClient, movieID)
+	movie, cacheStatus, err := loadMovie(r.Context(), movieID)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		dispatchUpstreamError(w, err)
 		return
 	}
 	if movie == nil {
-		movie, err = getMovieByIDFromAPI(movieID)
-		if err != nil {
-			utils.Dispatch500Error(w, err)
-			return
-		}
-		if movie == nil {
-			utils.Dispatch404Error(w, "movie with id %s not found", err)
+		utils.Dispatch404Error(w, fmt.Sprintf("movie with id %s not found", movieID), nil)
+		return
+	}
+	setCacheStatus(w, cacheStatus)
+
+	query.MovieID = movie.ID
+	var page interface{}
+	if tree, _ := strconv.ParseBool(r.URL.Query().Get("tree")); tree {
+		page, err = models.Comments.FetchThreads(r.Context(), query)
+	} else {
+		page, err = models.Comments.FetchPage(r.Context(), query)
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidCursor) {
+			utils.Dispatch400Error(w, "cursor does not belong to this sort", nil)
 			return
-		} else {
-			if err := cacheMovie(movieID, movie, redisClient); err != nil {
-				utils.Dispatch500Error(w, err)
-				return
-			}
 		}
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "fetch movie comments successfully",
+		Data:    page,
 	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
 
-	characters := make([]Character, 0)
-	for _, characterURL := range movie.Characters {
-		var character *Character
-		// fetch from redis first
-		key := fmt.Sprintf("movie_character:%s:%s", movieID, characterURL)
-		val, err := redisClient.Get(key).Result()
-		if err != nil {
-			if err == redis.Nil {
-				resp, err := http.Get(characterURL)
-				if err != nil {
-					utils.Dispatch500Error(w, err)
-				}
-				defer resp.Body.Close()
+func FetchMovieCharacters(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
 
-				if resp.StatusCode != http.StatusOK {
-					err := fmt.Errorf("received non-OK status code %d from API", resp.StatusCode)
-					utils.Dispatch500Error(w, err)
-					return
-				}
+	vars := mux.Vars(r)
+	movieID := vars["movie_id"]
+	queryParams := r.URL.Query()
+	sortBy := queryParams.Get("sort_by")
+	sortOrder := queryParams.Get("sort_order")
 
-				err = json.NewDecoder(resp.Body).Decode(&character)
-				if err != nil {
-					utils.Dispatch500Error(w, err)
-					return
-				}
+	movie, cacheStatus, err := loadMovie(r.Context(), movieID)
+	if err != nil {
+		dispatchUpstreamError(w, err)
+		return
+	}
+	if movie == nil {
+		utils.Dispatch404Error(w, fmt.Sprintf("movie with id %s not found", movieID), nil)
+		return
+	}
+	setCacheStatus(w, cacheStatus)
 
-				if character == nil {
-					utils.Dispatch404Error(w, "character with id %s not found", err)
-					return
-				}
+	resolved, charactersStatus, err := resolveCharacters(r.Context(), movie.Characters, GetConfig().CharacterWorkers)
+	if err != nil {
+		if errors.Is(err, errCharacterNotFound) {
+			utils.Dispatch404Error(w, err.Error(), nil)
+			return
+		}
+		dispatchUpstreamError(w, err)
+		return
+	}
+	setCacheStatus(w, mergeCacheStatus(cacheStatus, charactersStatus))
 
-				// Cache character data in Redis
-				characterJSON, err := json.Marshal(character)
-				if err != nil {
-					utils.Dispatch500Error(w, err)
-					return
-				}
-				if err := redisClient.Set(key, string(characterJSON), 0).Err(); err != nil {
-					utils.Dispatch500Error(w, err)
-					return
-				}
+	characters := make([]Character, 0, len(resolved))
+	for _, character := range resolved {
+		if character.Height != "unknown" {
+			characters = append(characters, *character)
+		}
+	}
 
+	// Sort characters based on the specified field and order, ties keep the order of the movie
+	sort.SliceStable(characters, func(i, j int) bool {
+		switch sortBy {
+		case "name":
+			if sortOrder == "asc" {
+				return characters[i].Name < characters[j].Name
 			} else {
-				utils.Dispatch500Error(w, err)
-				return
+				return characters[i].Name > characters[j].Name
 			}
-		} else {
-			if err := json.Unmarshal([]byte(val), &character); err != nil {
-				utils.Dispatch500Error(w, err)
-				return
+		case "gender":
+			if sortOrder == "asc" {
+				return characters[i].Gender < characters[j].Gender
+			} else {
+				return characters[i].Gender > characters[j].Gender
 			}
-		}
-
-		// Sort characters based on the specified field and order
-		sort.Slice(characters, func(i, j int) bool {
-			switch sortBy {
-			case "name":
-				if sortOrder == "asc" {
-					return characters[i].Name < characters[j].Name
-				} else {
-					return characters[i].Name > characters[j].Name
-				}
-			case "gender":
-				if sortOrder == "asc" {
-					return characters[i].Gender < characters[j].Gender
-				} else {
-					return characters[i].Gender > characters[j].Gender
-				}
-			case "height":
-				h1, err1 := strconv.ParseFloat(characters[i].Height, 64)
-				h2, err2 := strconv.ParseFloat(characters[j].Height, 64)
-				if err1 != nil || err2 != nil {
-					// If there was an error parsing the height value, treat the characters as equal
-					return false
-				}
-				if sortOrder == "asc" {
-					return h1 < h2
-				} else {
-					return h1 > h2
-				}
-			default:
-				// If an invalid sort field was provided, treat the characters as equal
+		case "height":
+			h1, err1 := strconv.ParseFloat(characters[i].Height, 64)
+			h2, err2 := strconv.ParseFloat(characters[j].Height, 64)
+			if err1 != nil || err2 != nil {
+				// If there was an error parsing the height value, treat the characters as equal
 				return false
 			}
-		})
-
-		if character.Height != "unknown" {
-			height, err := strconv.ParseFloat(character.Height, 64)
-			if err != nil {
-				utils.Dispatch500Error(w, err)
-				return
+			if sortOrder == "asc" {
+				return h1 < h2
+			} else {
+				return h1 > h2
 			}
-			character.Height = utils.CmToFeetInches(height)
-			characters = append(characters, *character)
+		default:
+			// If an invalid sort field was provided, treat the characters as equal
+			return false
+		}
+	})
+
+	for i := range characters {
+		height, err := strconv.ParseFloat(characters[i].Height, 64)
+		if err != nil {
+			utils.DispatchServerError(w, err)
+			return
 		}
+		characters[i].Height = utils.CmToFeetInches(height)
 	}
 
 	response := utils.APIResponse{
@@ -413,67 +619,278 @@ func FetchMovieCharacters(w http.ResponseWriter, r *http.Request) {
 	}
 	responseJSON, err := json.Marshal(response)
 	if err != nil {
-		utils.Dispatch500Error(w, err)
+		utils.DispatchServerError(w, err)
 		return
 	}
 	w.Write(responseJSON)
 }
 
-func getMovieByIDFromRedis(client *redis.Client, movieID string) (*Movie, error) {
-	movieJSON, err := client.Get(movieID).Result()
+// parseCommentPageQuery reads the limit, sort, after and before query parameters of a comment listing
+func parseCommentPageQuery(r *http.Request) (data.CommentPageQuery, error) {
+	queryParams := r.URL.Query()
+	query := data.CommentPageQuery{
+		Sort:  data.SortNewest,
+		Limit: defaultCommentPageSize,
+	}
+
+	if limit := queryParams.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 || value > maxCommentPageSize {
+			return query, fmt.Errorf("limit must be a number between 1 and %d", maxCommentPageSize)
+		}
+		query.Limit = value
+	}
+	if sortBy := queryParams.Get("sort"); sortBy != "" {
+		switch sortBy {
+		case data.SortNewest, data.SortOldest, data.SortScore, data.SortHot:
+			query.Sort = sortBy
+		default:
+			return query, fmt.Errorf("sort must be one of %s, %s, %s, %s", data.SortNewest, data.SortOldest, data.SortScore, data.SortHot)
+		}
+	}
+
+	after, before := queryParams.Get("after"), queryParams.Get("before")
+	if after != "" && before != "" {
+		return query, errors.New("after and before can't be used together")
+	}
+	var err error
+	if after != "" {
+		if query.After, err = data.DecodeCursor(after); err != nil {
+			return query, err
+		}
+	}
+	if before != "" {
+		if query.Before, err = data.DecodeCursor(before); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+// attachComments joins the total comment count and the most recent comments (up to Config.EmbeddedComments) to each movie,
+// with a single query however many movies there are
+func attachComments(ctx context.Context, movies ...*Movie) error {
+	movieIDs := make([]string, 0, len(movies))
+	for _, movie := range movies {
+		movieIDs = append(movieIDs, movie.ID)
+	}
+	summaries, err := models.Comments.FetchSummaries(ctx, movieIDs, GetConfig().EmbeddedComments)
 	if err != nil {
-		if err == redis.Nil {
-			return nil, nil
+		return err
+	}
+	for _, movie := range movies {
+		summary := summaries[movie.ID]
+		movie.Comments = summary.Latest
+		movie.CommentCount = summary.Count
+		movie.TopComment = summary.Top
+	}
+	return nil
+}
+
+// readReactionPayload decodes and validates the body of the reaction endpoints, writing a 400 response when it is invalid
+func readReactionPayload(w http.ResponseWriter, r *http.Request) (*ReactionPayload, bool) {
+	var input ReactionPayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return nil, false
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return nil, false
+	}
+	validate := validator.New()
+	if err := validate.Struct(input); err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return nil, false
+	}
+	allowed := append([]string{data.ReactionUpvote, data.ReactionDownvote}, GetConfig().ReactionEmojis...)
+	for _, reaction := range allowed {
+		if input.Reaction == reaction {
+			return &input, true
 		}
-		return nil, err
 	}
+	utils.Dispatch400Error(w, fmt.Sprintf("reaction must be one of %s", strings.Join(allowed, " ")), nil)
+	return nil, false
+}
 
-	var movie Movie
-	err = json.Unmarshal([]byte(movieJSON), &movie)
+// clientIdentity tells the clients voting, flagging or posting apart: their account when signed in, their api key
+// when they have one and a keyed hash of their address otherwise, whatever the ip privacy mode. a truncated address
+// would lump a whole network together
+func clientIdentity(r *http.Request) string {
+	if user := UserFromContext(r.Context()); user != nil {
+		return data.IdentityUserPrefix + strconv.Itoa(user.ID)
+	}
+	if key := APIKeyFromContext(r.Context()); key != nil {
+		return data.IdentityAPIKeyPrefix + strconv.Itoa(key.ID)
+	}
+	return ipPrivacy.Identity(clientIP(r))
+}
+
+// isCommentAuthor tells whether the client behind r wrote comment, comments posted from an account belong to the account.
+// a truncated address is shared by a whole network, so anonymous authors are then recognised by their author key alone
+func isCommentAuthor(r *http.Request, comment *data.Comment) bool {
+	if comment.UserID != nil {
+		user := UserFromContext(r.Context())
+		return user != nil && user.ID == *comment.UserID
+	}
+	if comment.IPFormat == data.IPFormatTruncated {
+		return ipPrivacy.MatchesAuthorKey(comment.AuthorKey, clientIP(r))
+	}
+	return ipPrivacy.Matches(comment.UserPublicIP, comment.IPFormat, clientIP(r))
+}
+
+// getCommentFromRequest loads the comment named by the {id} route variable, writing a 400 or 404 response when there isn't one
+func getCommentFromRequest(w http.ResponseWriter, r *http.Request) (*data.Comment, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
 	if err != nil {
-		return nil, err
+		utils.Dispatch400Error(w, "invalid comment id", nil)
+		return nil, false
 	}
+	comment, err := models.Comments.GetByID(r.Context(), id)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return nil, false
+	}
+	if comment == nil {
+		utils.Dispatch404Error(w, fmt.Sprintf("comment with id %d not found", id), nil)
+		return nil, false
+	}
+	return comment, true
+}
 
-	return &movie, nil
+// getApprovedCommentFromRequest is getCommentFromRequest for public endpoints, comments that aren't approved are not found
+func getApprovedCommentFromRequest(w http.ResponseWriter, r *http.Request) (*data.Comment, bool) {
+	comment, ok := getCommentFromRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+	if comment.Status != data.StatusApproved {
+		utils.Dispatch404Error(w, fmt.Sprintf("comment with id %d not found", comment.ID), nil)
+		return nil, false
+	}
+	return comment, true
+}
+
+// newCommentStatus is the status new and edited comments start in, set by Config.CommentAutoApprove
+func newCommentStatus() string {
+	if GetConfig().CommentAutoApprove {
+		return data.StatusApproved
+	}
+	return data.StatusPending
 }
 
-func getMovieByIDFromAPI(movieID string) (*Movie, error) {
-	url := fmt.Sprintf("https://swapi.dev/api/films/%s/", movieID)
-	resp, err := http.Get(url)
+// loadMovies reads the list of films from the cache, falling back to the movie provider. a stale list is served as is and refreshed in the background
+func loadMovies(ctx context.Context) ([]Movie, CacheStatus, error) {
+	var movies []Movie
+	found, stale, err := readCached(ctx, movieListCacheKey, &movies)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	if found {
+		if !stale {
+			return movies, CacheFresh, nil
+		}
+		revalidate(movieListCacheKey, func(ctx context.Context) error {
+			_, err := fetchMovies(ctx)
+			return err
+		})
+		return movies, CacheStale, nil
 	}
-	defer resp.Body.Close()
 
-	var data struct {
-		Title        string   `json:"title"`
-		OpeningCrawl string   `json:"opening_crawl"`
-		Characters   []string `json:"characters"`
+	movies, err = fetchMovies(ctx)
+	if err != nil {
+		return nil, "", err
 	}
-	err = json.NewDecoder(resp.Body).Decode(&data)
+	return movies, CacheOrigin, nil
+}
+
+// fetchMovies lists the films of the movie provider and caches the list, along with any movie in it that is missing or
+// stale in the cache. concurrent fetches of the list share a single upstream call
+func fetchMovies(ctx context.Context) ([]Movie, error) {
+	result, err := filmFetches.do(ctx, movieListCacheKey, func(ctx context.Context) (interface{}, error) {
+		movies, err := movieProvider.ListFilms(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeCached(ctx, movieListCacheKey, movies, GetConfig().MovieTTL); err != nil {
+			return nil, err
+		}
+		for i := range movies {
+			cachedMovie, stale, err := getMovieFromCache(ctx, movies[i].ID)
+			if err != nil {
+				return nil, err
+			}
+			if cachedMovie == nil || stale {
+				if err := cacheMovie(ctx, movies[i].ID, &movies[i]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return movies, nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	// every caller gets its own copy, handlers go on to attach their comments to it
+	return append([]Movie(nil), result.([]Movie)...), nil
+}
 
-	movie := &Movie{
-		Title:        data.Title,
-		OpeningCrawl: data.OpeningCrawl,
-		Characters:   data.Characters,
+// loadMovie reads a movie from the cache, falling back to the movie provider. a stale movie is served as is and refreshed in the background
+func loadMovie(ctx context.Context, movieID string) (*Movie, CacheStatus, error) {
+	movie, stale, err := getMovieFromCache(ctx, movieID)
+	if err != nil {
+		return nil, "", err
+	}
+	if movie != nil {
+		if !stale {
+			return movie, CacheFresh, nil
+		}
+		revalidate(movieCacheKey(movieID), func(ctx context.Context) error {
+			_, err := fetchMovie(ctx, movieID)
+			return err
+		})
+		return movie, CacheStale, nil
 	}
 
-	return movie, nil
+	movie, err = fetchMovie(ctx, movieID)
+	if err != nil || movie == nil {
+		return nil, "", err
+	}
+	return movie, CacheOrigin, nil
 }
 
-func cacheMovie(movieID string, movie *Movie, client *redis.Client) error {
-	movieJSON, err := json.Marshal(movie)
-	if err != nil {
-		return err
+// fetchMovie gets a movie from the movie provider and caches it, returns nil if the movie does not exist.
+// concurrent fetches of the same movie share a single upstream call
+func fetchMovie(ctx context.Context, movieID string) (*Movie, error) {
+	result, err := filmFetches.do(ctx, movieID, func(ctx context.Context) (interface{}, error) {
+		// check the movies api
+		movie, err := movieProvider.GetFilm(ctx, movieID)
+		if err != nil || movie == nil {
+			return nil, err
+		}
+		// cache movie
+		if err := cacheMovie(ctx, movieID, movie); err != nil {
+			return nil, err
+		}
+		return *movie, nil
+	})
+	if err != nil || result == nil {
+		return nil, err
 	}
+	// every caller gets its own copy, handlers go on to attach their comments to it
+	movie := result.(Movie)
+	return &movie, nil
+}
 
-	err = client.Set(movieID, string(movieJSON), 0).Err()
-	if err != nil {
-		return err
+func getMovieFromCache(ctx context.Context, movieID string) (*Movie, bool, error) {
+	var movie Movie
+	found, stale, err := readCached(ctx, movieCacheKey(movieID), &movie)
+	if err != nil || !found {
+		return nil, false, err
 	}
+	return &movie, stale, nil
+}
 
-	return nil
+func cacheMovie(ctx context.Context, movieID string, movie *Movie) error {
+	return writeCached(ctx, movieCacheKey(movieID), movie, GetConfig().MovieTTL)
 }
@@ -0,0 +1,289 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// reasons a comment body can be rejected for, clients can rely on these staying the same
+const (
+	ReasonTooShort     = "too_short"
+	ReasonTooLong      = "too_long"
+	ReasonTooManyLinks = "too_many_links"
+	ReasonBannedWord   = "banned_word"
+	ReasonDuplicate    = "duplicate"
+)
+
+const (
+	BannedWordsMask   = "mask"
+	BannedWordsReject = "reject"
+)
+
+// the comments.body column is a VARCHAR(500), nothing longer can be stored
+const maxCommentLength = 500
+
+// CommentDraft is a comment body on its way to being stored, filters may rewrite Body
+type CommentDraft struct {
+	Body string
+	// who is posting it, see clientIdentity
+	Author string
+}
+
+// FilterRejection says which filter turned a comment down and why
+type FilterRejection struct {
+	Filter  string `json:"filter"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+// CommentFilter checks a comment body before it is stored, returning nil to let it through
+type CommentFilter interface {
+	Filter(ctx context.Context, draft *CommentDraft) *FilterRejection
+}
+
+// CommentRecorder is a CommentFilter that remembers the comments it let through. Record is called once the comment has
+// been written, in the same unit of work, and claims it atomically so only one of several identical comments posted at
+// once gets through. Forget drops the claim when the comment ends up not being stored after all
+type CommentRecorder interface {
+	Record(ctx context.Context, draft *CommentDraft) *FilterRejection
+	Forget(ctx context.Context, draft *CommentDraft)
+}
+
+// errCommentRejected rolls back the unit of work writing a comment a CommentRecorder turned down
+var errCommentRejected = errors.New("comment rejected by a filter")
+
+// the filters run by runCommentFilters, in order
+var commentFilters []CommentFilter
+
+// newCommentFilters builds the pipeline described by config. the duplicate check goes last so it is only made for bodies every other filter accepted
+func newCommentFilters(config Config) []CommentFilter {
+	filters := []CommentFilter{
+		LengthFilter{Min: 1, Max: config.CommentMaxLength},
+		LinkFilter{Max: config.CommentMaxLinks},
+	}
+	if len(config.BannedWords) > 0 {
+		filters = append(filters, NewBannedWordsFilter(config.BannedWords, config.BannedWordsMode))
+	}
+	if config.CommentDuplicateWindow > 0 {
+		filters = append(filters, DuplicateFilter{Window: config.CommentDuplicateWindow})
+	}
+	return filters
+}
+
+// runCommentFilters passes the draft through every filter, stopping at the first rejection
+func runCommentFilters(ctx context.Context, draft *CommentDraft) *FilterRejection {
+	for _, filter := range commentFilters {
+		if rejection := filter.Filter(ctx, draft); rejection != nil {
+			return rejection
+		}
+	}
+	return nil
+}
+
+// recordComment has every CommentRecorder of the pipeline remember the draft, see CommentRecorder.
+// what was recorded is forgotten again when one of them turns the draft down
+func recordComment(ctx context.Context, draft *CommentDraft) *FilterRejection {
+	for i, filter := range commentFilters {
+		recorder, ok := filter.(CommentRecorder)
+		if !ok {
+			continue
+		}
+		if rejection := recorder.Record(ctx, draft); rejection != nil {
+			forgetComment(ctx, draft, commentFilters[:i])
+			return rejection
+		}
+	}
+	return nil
+}
+
+// forgetComment has every CommentRecorder among filters forget the draft
+func forgetComment(ctx context.Context, draft *CommentDraft, filters []CommentFilter) {
+	for _, filter := range filters {
+		if recorder, ok := filter.(CommentRecorder); ok {
+			recorder.Forget(ctx, draft)
+		}
+	}
+}
+
+// LengthFilter keeps the body between Min and Max characters, surrounding whitespace is trimmed first
+type LengthFilter struct {
+	Min int
+	Max int
+}
+
+func (f LengthFilter) Filter(ctx context.Context, draft *CommentDraft) *FilterRejection {
+	draft.Body = strings.TrimSpace(draft.Body)
+	length := utf8.RuneCountInString(draft.Body)
+	if length < f.Min {
+		return &FilterRejection{Filter: "length", Reason: ReasonTooShort, Message: fmt.Sprintf("comment is too short, the minimum is %d characters", f.Min)}
+	}
+	max := f.Max
+	if max <= 0 || max > maxCommentLength {
+		max = maxCommentLength
+	}
+	if length > max {
+		return &FilterRejection{Filter: "length", Reason: ReasonTooLong, Message: fmt.Sprintf("comment is too long, the maximum is %d characters", max)}
+	}
+	return nil
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// LinkFilter rejects bodies with more than Max links
+type LinkFilter struct {
+	Max int
+}
+
+func (f LinkFilter) Filter(ctx context.Context, draft *CommentDraft) *FilterRejection {
+	if links := len(linkPattern.FindAllStringIndex(draft.Body, -1)); links > f.Max {
+		return &FilterRejection{Filter: "links", Reason: ReasonTooManyLinks, Message: fmt.Sprintf("comment has too many links, the maximum is %d", f.Max)}
+	}
+	return nil
+}
+
+// BannedWordsFilter either masks banned words with asterisks or rejects bodies containing them, words match whole and case insensitively
+type BannedWordsFilter struct {
+	Mode     string
+	patterns []*regexp.Regexp
+}
+
+func NewBannedWordsFilter(words []string, mode string) *BannedWordsFilter {
+	patterns := make([]*regexp.Regexp, 0, len(words))
+	for _, word := range words {
+		if word != "" {
+			patterns = append(patterns, regexp.MustCompile(`(?i)`+regexp.QuoteMeta(word)))
+		}
+	}
+	if mode != BannedWordsReject {
+		mode = BannedWordsMask
+	}
+	return &BannedWordsFilter{Mode: mode, patterns: patterns}
+}
+
+func (f *BannedWordsFilter) Filter(ctx context.Context, draft *CommentDraft) *FilterRejection {
+	found := f.find(draft.Body)
+	if len(found) == 0 {
+		return nil
+	}
+	if f.Mode == BannedWordsReject {
+		return &FilterRejection{Filter: "banned_words", Reason: ReasonBannedWord, Message: "comment contains a banned word"}
+	}
+	var masked strings.Builder
+	last := 0
+	for _, span := range found {
+		masked.WriteString(draft.Body[last:span[0]])
+		masked.WriteString(strings.Repeat("*", utf8.RuneCountInString(draft.Body[span[0]:span[1]])))
+		last = span[1]
+	}
+	masked.WriteString(draft.Body[last:])
+	draft.Body = masked.String()
+	return nil
+}
+
+// find returns the byte offsets of the banned words in body, in order and merged where they overlap. a word only counts
+// when no letter or digit sticks to either end of it, checked here since the \b of regexp only knows ascii ones
+func (f *BannedWordsFilter) find(body string) [][2]int {
+	var found [][2]int
+	for _, pattern := range f.patterns {
+		for start := 0; start < len(body); {
+			loc := pattern.FindStringIndex(body[start:])
+			if loc == nil {
+				break
+			}
+			from, to := start+loc[0], start+loc[1]
+			if !wordCharBefore(body, from) && !wordCharAfter(body, to) {
+				found = append(found, [2]int{from, to})
+				start = to
+				continue
+			}
+			// another occurrence may still start inside this one
+			_, size := utf8.DecodeRuneInString(body[from:])
+			start = from + size
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i][0] < found[j][0] })
+	merged := found[:0]
+	for _, span := range found {
+		if n := len(merged); n > 0 && span[0] <= merged[n-1][1] {
+			if span[1] > merged[n-1][1] {
+				merged[n-1][1] = span[1]
+			}
+			continue
+		}
+		merged = append(merged, span)
+	}
+	return merged
+}
+
+func isWordChar(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+func wordCharBefore(s string, i int) bool {
+	r, size := utf8.DecodeLastRuneInString(s[:i])
+	return size > 0 && isWordChar(r)
+}
+
+func wordCharAfter(s string, i int) bool {
+	r, size := utf8.DecodeRuneInString(s[i:])
+	return size > 0 && isWordChar(r)
+}
+
+// DuplicateFilter rejects a body the same author already posted within Window, bodies are compared ignoring case and spacing.
+// Filter turns down bodies already recorded, a body is only recorded once the comment has been written, see CommentRecorder
+type DuplicateFilter struct {
+	Window time.Duration
+}
+
+var duplicateRejection = FilterRejection{Filter: "duplicate", Reason: ReasonDuplicate, Message: "you already posted this comment"}
+
+func (f DuplicateFilter) Filter(ctx context.Context, draft *CommentDraft) *FilterRejection {
+	_, found, err := movieCache.Get(ctx, duplicateKey(draft))
+	if err != nil {
+		// not being able to check is no reason to turn the comment down
+		log.Printf("failed to check for duplicate comment: %s", err)
+		return nil
+	}
+	if found {
+		rejection := duplicateRejection
+		return &rejection
+	}
+	return nil
+}
+
+func (f DuplicateFilter) Record(ctx context.Context, draft *CommentDraft) *FilterRejection {
+	stored, err := movieCache.SetIfAbsent(ctx, duplicateKey(draft), []byte("1"), f.Window)
+	if err != nil {
+		log.Printf("failed to remember comment body: %s", err)
+		return nil
+	}
+	if !stored {
+		// an identical comment was written since Filter checked
+		rejection := duplicateRejection
+		return &rejection
+	}
+	return nil
+}
+
+func (f DuplicateFilter) Forget(ctx context.Context, draft *CommentDraft) {
+	if err := movieCache.Delete(ctx, duplicateKey(draft)); err != nil {
+		log.Printf("failed to forget comment body: %s", err)
+	}
+}
+
+// duplicateKey is where the body of draft is remembered
+func duplicateKey(draft *CommentDraft) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(draft.Body)), " ")
+	sum := sha256.Sum256([]byte(normalized))
+	return fmt.Sprintf("comment_body:%s:%s", draft.Author, hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// keys written before movies had a canonical id
+const (
+	legacyMovieTitlePrefix     = "movie_title:"
+	legacyMovieCounterKey      = "movie_id_counter"
+	legacyMovieCharacterPrefix = "movie_character:"
+)
+
+/*
+MigrateMovieIDs is a one-off migration to the canonical movie ids.
+FetchMovies used to number movies with the redis movie_id_counter while FetchMovie and AddComment used the swapi film number,
+both under bare numeric redis keys. this works out which canonical id every old id stood for (by the title of the movie stored under it),
+moves comments.movie_id over to it and rewrites the redis keys. redisClient may be nil when the cache is not backed by redis.
+it has to run after App.Initialize
+*/
+func MigrateMovieIDs(ctx context.Context, redisClient *redis.Client) error {
+	log.Println("running movie id migration :::::::::::::")
+
+	movies, err := movieProvider.ListFilms(ctx)
+	if err != nil {
+		return err
+	}
+	canonicalIDs := make(map[string]string, len(movies))
+	for _, movie := range movies {
+		canonicalIDs[movie.Title] = movie.ID
+	}
+
+	// old id -> canonical id, ids with no redis trace are taken to be swapi film numbers which are already canonical
+	mapping := make(map[string]string)
+	var legacyMovies map[string]*Movie
+	if redisClient != nil {
+		if legacyMovies, err = collectLegacyMovieIDs(ctx, redisClient, canonicalIDs, mapping); err != nil {
+			return err
+		}
+	}
+
+	// comments first, if this fails the redis keys holding the mapping are still around for another run
+	movieIDs, err := models.Comments.MovieIDs(ctx)
+	if err != nil {
+		return err
+	}
+	remap := make(map[string]string)
+	for _, movieID := range movieIDs {
+		if newID, ok := mapping[movieID]; ok && newID != movieID {
+			remap[movieID] = newID
+		}
+	}
+	updated, err := models.Comments.RemapMovieIDs(ctx, remap)
+	if err != nil {
+		return err
+	}
+	log.Printf("moved %d comments to canonical movie ids", updated)
+
+	if redisClient != nil {
+		if err := rewriteLegacyMovieKeys(ctx, redisClient, mapping, legacyMovies); err != nil {
+			return err
+		}
+	}
+
+	log.Println("complete movie id migration")
+	return nil
+}
+
+// collectLegacyMovieIDs fills mapping from the title lookups and the movies stored under bare numeric keys, it returns those movies by key
+func collectLegacyMovieIDs(ctx context.Context, client *redis.Client, canonicalIDs map[string]string, mapping map[string]string) (map[string]*Movie, error) {
+	titles := client.Scan(ctx, 0, legacyMovieTitlePrefix+"*", 100).Iterator()
+	for titles.Next(ctx) {
+		key := titles.Val()
+		oldID, err := client.Get(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if newID, ok := canonicalIDs[strings.TrimPrefix(key, legacyMovieTitlePrefix)]; ok {
+			mapping[oldID] = newID
+		}
+	}
+	if err := titles.Err(); err != nil {
+		return nil, err
+	}
+
+	// whatever movie sits under a numeric key is the one AddComment checked the comment against, so it has the final say
+	legacyMovies := make(map[string]*Movie)
+	keys := client.Scan(ctx, 0, "[0-9]*", 100).Iterator()
+	for keys.Next(ctx) {
+		key := keys.Val()
+		if _, err := strconv.Atoi(key); err != nil {
+			continue
+		}
+		content, err := client.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		movie, err := decodeLegacyMovie(content)
+		if err != nil {
+			log.Printf("skipping unreadable movie under key %s: %s", key, err)
+			continue
+		}
+		legacyMovies[key] = movie
+		if newID, ok := canonicalIDs[movie.Title]; ok {
+			mapping[key] = newID
+		}
+	}
+	return legacyMovies, keys.Err()
+}
+
+// rewriteLegacyMovieKeys moves cached movies and characters to their canonical keys and drops the old lookups
+func rewriteLegacyMovieKeys(ctx context.Context, client *redis.Client, mapping map[string]string, legacyMovies map[string]*Movie) error {
+	for key, movie := range legacyMovies {
+		if newID, ok := mapping[key]; ok {
+			movie.ID = newID
+			movie.Comments = nil
+			movie.CommentCount = 0
+			if err := cacheMovie(ctx, newID, movie); err != nil {
+				return err
+			}
+		}
+		if err := client.Del(ctx, key).Err(); err != nil {
+			return err
+		}
+	}
+
+	characters := client.Scan(ctx, 0, legacyMovieCharacterPrefix+"*", 100).Iterator()
+	for characters.Next(ctx) {
+		key := characters.Val()
+		// movie_character:{movie_id}:{character_url}, the url has colons of its own
+		parts := strings.SplitN(key, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if err := client.Rename(ctx, key, characterCacheKey(parts[2])).Err(); err != nil && err != redis.Nil {
+			return err
+		}
+	}
+	if err := characters.Err(); err != nil {
+		return err
+	}
+
+	titles := client.Scan(ctx, 0, legacyMovieTitlePrefix+"*", 100).Iterator()
+	for titles.Next(ctx) {
+		if err := client.Del(ctx, titles.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	if err := titles.Err(); err != nil {
+		return err
+	}
+	return client.Del(ctx, legacyMovieCounterKey).Err()
+}
+
+// decodeLegacyMovie reads a movie cached either as plain json or wrapped in a cachedEntry
+func decodeLegacyMovie(content []byte) (*Movie, error) {
+	var entry cachedEntry
+	if err := json.Unmarshal(content, &entry); err == nil && len(entry.Value) > 0 {
+		content = entry.Value
+	}
+	// the old ID field held either a number or nothing at all, it is recomputed anyway
+	var movie struct {
+		Movie
+		ID interface{} `json:"ID"`
+	}
+	if err := json.Unmarshal(content, &movie); err != nil {
+		return nil, err
+	}
+	return &movie.Movie, nil
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator"
+	"github.com/showbaba/movies-api/data"
+	"github.com/showbaba/movies-api/utils"
+)
+
+func FlagComment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	var input FlagCommentPayload
+	if body, err := io.ReadAll(r.Body); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", err)
+		return
+	} else if err := json.Unmarshal(body, &input); err != nil {
+		utils.Dispatch400Error(w, "invalid request payload", nil)
+		return
+	}
+	validate := validator.New()
+	err := validate.Struct(input)
+	if err != nil {
+		validationErrors := err.(validator.ValidationErrors)
+		utils.Dispatch400Error(w, "validation error", validationErrors)
+		return
+	}
+
+	comment, ok := getApprovedCommentFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := models.Comments.Flag(r.Context(), comment, clientIdentity(r), input.Reason, GetConfig().CommentFlagThreshold); err != nil {
+		// deleted since it was read
+		if errors.Is(err, data.ErrCommentNotFound) {
+			utils.Dispatch404Error(w, fmt.Sprintf("comment with id %d not found", comment.ID), nil)
+			return
+		}
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "comment flagged successfully",
+		Data:    map[string]string{"id": fmt.Sprint(comment.ID)},
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func FetchModerationQueue(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	query, err := parseCommentPageQuery(r)
+	if err != nil {
+		utils.Dispatch400Error(w, err.Error(), nil)
+		return
+	}
+	// the queue is worked through oldest first unless asked otherwise
+	if r.URL.Query().Get("sort") == "" {
+		query.Sort = data.SortOldest
+	}
+	query.Statuses = []string{data.StatusPending, data.StatusFlagged}
+	if statuses := r.URL.Query().Get("status"); statuses != "" {
+		query.Statuses = nil
+		for _, status := range strings.Split(statuses, ",") {
+			switch status {
+			case data.StatusPending, data.StatusApproved, data.StatusRejected, data.StatusFlagged:
+				query.Statuses = append(query.Statuses, status)
+			default:
+				utils.Dispatch400Error(w, fmt.Sprintf("unknown comment status %s", status), nil)
+				return
+			}
+		}
+	}
+	query.MovieID = r.URL.Query().Get("movie_id")
+
+	page, err := models.Comments.FetchPage(r.Context(), query)
+	if err != nil {
+		if errors.Is(err, data.ErrInvalidCursor) {
+			utils.Dispatch400Error(w, "cursor does not belong to this sort", nil)
+			return
+		}
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: "fetch moderation queue successfully",
+		Data:    page,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
+
+func ApproveComment(w http.ResponseWriter, r *http.Request) {
+	moderateComment(w, r, data.StatusApproved)
+}
+
+func RejectComment(w http.ResponseWriter, r *http.Request) {
+	moderateComment(w, r, data.StatusRejected)
+}
+
+func moderateComment(w http.ResponseWriter, r *http.Request, status string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+
+	comment, ok := getCommentFromRequest(w, r)
+	if !ok {
+		return
+	}
+	if err := models.Comments.Moderate(r.Context(), comment, status); err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	response := utils.APIResponse{
+		Status:  http.StatusOK,
+		Message: fmt.Sprintf("comment %s successfully", status),
+		Data:    comment,
+	}
+	responseJSON, err := json.Marshal(response)
+	if err != nil {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	w.Write(responseJSON)
+}
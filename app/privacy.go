@@ -0,0 +1,181 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/showbaba/movies-api/data"
+)
+
+// how often the retention job looks for raw addresses past IPRetention
+const ipRetentionInterval = time.Hour
+
+// IPPrivacy decides how the address of a commenter, voter or flagger is stored and which handle stands in for it publicly
+type IPPrivacy struct {
+	// the data.IPFormat new addresses are stored in
+	Format string
+	key    []byte
+	// whether key came from the config rather than being made up at startup
+	persistentKey bool
+}
+
+// NewIPPrivacy builds the policy selected by config.IPPrivacyMode. hashing needs config.IPHashKey, without one handles
+// are keyed with a random key and so change whenever the api restarts
+func NewIPPrivacy(config Config) (*IPPrivacy, error) {
+	key := []byte(config.IPHashKey)
+	persistentKey := len(key) > 0
+	switch config.IPPrivacyMode {
+	case data.IPFormatHMAC:
+		if len(key) == 0 {
+			return nil, fmt.Errorf("ip privacy mode %q requires IP_HASH_KEY", config.IPPrivacyMode)
+		}
+	case "", data.IPFormatRaw, data.IPFormatTruncated:
+	default:
+		return nil, fmt.Errorf("unknown ip privacy mode %q", config.IPPrivacyMode)
+	}
+	if len(key) == 0 {
+		log.Println("IP_HASH_KEY is not set, author handles, voter identities and author keys won't survive a restart")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	format := config.IPPrivacyMode
+	if format == "" {
+		format = data.IPFormatRaw
+	}
+	return &IPPrivacy{Format: format, key: key, persistentKey: persistentKey}, nil
+}
+
+// Protect turns ip into what is stored for it and the data.IPFormat that is in
+func (p *IPPrivacy) Protect(ip string) (string, string) {
+	return p.protectAs(ip, p.Format), p.Format
+}
+
+func (p *IPPrivacy) protectAs(ip, format string) string {
+	switch format {
+	case data.IPFormatHMAC:
+		return p.sum(ip)
+	case data.IPFormatTruncated:
+		return truncateIP(ip)
+	default:
+		return ip
+	}
+}
+
+// Matches tells whether stored, kept in format, is what ip would have been stored as
+func (p *IPPrivacy) Matches(stored, format, ip string) bool {
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(p.protectAs(ip, format))) == 1
+}
+
+// AuthorKey is what recognises the author of an anonymous comment posted from ip once its stored address is truncated
+func (p *IPPrivacy) AuthorKey(ip string) string {
+	return p.sum("author:" + ip)
+}
+
+// MatchesAuthorKey tells whether authorKey is the AuthorKey of ip, comments stored without one match no one
+func (p *IPPrivacy) MatchesAuthorKey(authorKey, ip string) bool {
+	return authorKey != "" && subtle.ConstantTimeCompare([]byte(authorKey), []byte(p.AuthorKey(ip))) == 1
+}
+
+// Identity is what an anonymous voter or flagger from ip is stored as, a keyed hash whatever Format is
+func (p *IPPrivacy) Identity(ip string) string {
+	return data.IdentityAnonymousPrefix + p.sum(ip)
+}
+
+// Handle is the public pseudonym of ip
+func (p *IPPrivacy) Handle(ip string) string {
+	return "anon-" + p.sum("handle:" + ip)[:12]
+}
+
+// purgeFormat is what raw addresses are turned into once they are past their retention, they are hashed when there
+// is a key to hash them with that outlives the process and truncated otherwise
+func (p *IPPrivacy) purgeFormat() string {
+	if p.persistentKey {
+		return data.IPFormatHMAC
+	}
+	return data.IPFormatTruncated
+}
+
+func (p *IPPrivacy) sum(value string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isHexSum tells whether value looks like what sum returns
+func isHexSum(value string) bool {
+	decoded, err := hex.DecodeString(value)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// truncateIP zeroes the host part of ip, keeping the /24 of an IPv4 address and the /48 of an IPv6 one
+func truncateIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// StartIPRetention runs the retention job now and then every ipRetentionInterval in the background. it gives
+// comments from before ip privacy their author handle and rewrites raw addresses older than Config.IPRetention
+func StartIPRetention() {
+	go func() {
+		for {
+			retainIPs()
+			time.Sleep(ipRetentionInterval)
+		}
+	}()
+}
+
+func retainIPs() {
+	handles, err := models.Comments.FillAuthorHandles(context.Background(), ipPrivacy.Handle)
+	if err != nil {
+		// a comment has to keep its raw address until it has a handle, the handle can't be worked out afterwards
+		log.Printf("failed to fill author handles: %s", err)
+		return
+	}
+	if handles > 0 {
+		log.Printf("gave %d comments an author handle", handles)
+	}
+
+	// voters and flaggers were stored following the ip privacy mode before they were always hashed, which kept raw
+	// addresses past their retention. hashed ones were stored without the prefix and are kept as they are
+	identities, err := models.Comments.HashAnonymousIdentities(context.Background(), func(stored string) string {
+		if isHexSum(stored) {
+			return stored
+		}
+		return ipPrivacy.sum(stored)
+	})
+	if err != nil {
+		log.Printf("failed to hash voter and flagger addresses: %s", err)
+	} else if identities > 0 {
+		log.Printf("hashed the address of %d voters and flaggers", identities)
+	}
+
+	retention := GetConfig().IPRetention
+	if retention <= 0 {
+		return
+	}
+	format := ipPrivacy.purgeFormat()
+	purged, err := models.Comments.PurgeRawIPs(context.Background(), time.Now().Add(-retention), func(ip string) (string, string) {
+		return ipPrivacy.protectAs(ip, format), format
+	})
+	if err != nil {
+		log.Printf("failed to purge raw ips: %s", err)
+	} else if purged > 0 {
+		log.Printf("purged the raw ip of %d comments", purged)
+	}
+}
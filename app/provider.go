@@ -0,0 +1,123 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// MovieProvider is the upstream catalogue the handlers read films and characters from
+type MovieProvider interface {
+	// list every film in the catalogue
+	ListFilms(ctx context.Context) ([]Movie, error)
+	// get a single film by its upstream id, returns nil if the film does not exist
+	GetFilm(ctx context.Context, movieID string) (*Movie, error)
+	// get a character by the reference found in Movie.Characters, returns nil if it does not exist
+	GetCharacter(ctx context.Context, characterURL string) (*Character, error)
+}
+
+// NewMovieProvider builds the provider selected by config.MovieProvider
+func NewMovieProvider(config Config, client *http.Client) (MovieProvider, error) {
+	switch config.MovieProvider {
+	case "", "swapi":
+		return NewSWAPIProvider(config.SwapiURL, client), nil
+	case "fixtures":
+		return NewFixtureProvider(config.FixturesDir)
+	default:
+		return nil, fmt.Errorf("unknown movie provider %q", config.MovieProvider)
+	}
+}
+
+// filmIDFromURL derives the canonical id of a film from its swapi url, e.g https://swapi.dev/api/films/4/ is 4.
+// fallback is used when the url is missing
+func filmIDFromURL(url, fallback string) string {
+	if id := path.Base(strings.TrimSuffix(url, "/")); url != "" && id != "" && id != "." && id != "/" {
+		return id
+	}
+	return fallback
+}
+
+// SWAPIProvider talks to the Star Wars API (or any mirror of it) over http
+type SWAPIProvider struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewSWAPIProvider(baseURL string, client *http.Client) *SWAPIProvider {
+	if baseURL == "" {
+		baseURL = defaultSwapiURL
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &SWAPIProvider{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Client:  client,
+	}
+}
+
+func (p *SWAPIProvider) ListFilms(ctx context.Context) ([]Movie, error) {
+	var movieData struct {
+		Results []Movie `json:"results"`
+	}
+	found, err := p.getJSON(ctx, p.BaseURL+"/films/", &movieData)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("films not found at %s", p.BaseURL)
+	}
+	for i := range movieData.Results {
+		movieData.Results[i].ID = filmIDFromURL(movieData.Results[i].URL, "")
+	}
+	return movieData.Results, nil
+}
+
+func (p *SWAPIProvider) GetFilm(ctx context.Context, movieID string) (*Movie, error) {
+	var movie Movie
+	found, err := p.getJSON(ctx, fmt.Sprintf("%s/films/%s/", p.BaseURL, movieID), &movie)
+	if err != nil || !found {
+		return nil, err
+	}
+	movie.ID = filmIDFromURL(movie.URL, movieID)
+	return &movie, nil
+}
+
+func (p *SWAPIProvider) GetCharacter(ctx context.Context, characterURL string) (*Character, error) {
+	var character Character
+	found, err := p.getJSON(ctx, characterURL, &character)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &character, nil
+}
+
+// getJSON decodes the body of a GET request into v, it reports false when the upstream returns 404
+func (p *SWAPIProvider) getJSON(ctx context.Context, url string, v interface{}) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if retryableStatus(resp.StatusCode) {
+		return false, &upstreamUnavailableError{host: req.URL.Host, reason: fmt.Sprintf("received status code %d", resp.StatusCode)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("received non-OK status code %d from API", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
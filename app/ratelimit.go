@@ -0,0 +1,273 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+	"github.com/showbaba/movies-api/utils"
+)
+
+// rate limit groups, every route is in exactly one of them
+const (
+	// writes to comments, and the auth endpoints so passwords can't be guessed at speed
+	RateLimitComments = "comments"
+	// reads that can fan out to swapi
+	RateLimitMovies = "movies"
+	// everything else
+	RateLimitDefault = "default"
+)
+
+// the group of every route that isn't RateLimitDefault, by method and path template
+var rateLimitGroups = map[string]string{
+	"POST /movies/{movie_id}/comment":   RateLimitComments,
+	"PATCH /comments/{id}":              RateLimitComments,
+	"DELETE /comments/{id}":             RateLimitComments,
+	"POST /comments/{id}/reactions":     RateLimitComments,
+	"DELETE /comments/{id}/reactions":   RateLimitComments,
+	"POST /comments/{id}/flag":          RateLimitComments,
+	"POST /auth/register":               RateLimitComments,
+	"POST /auth/login":                  RateLimitComments,
+	"GET /movies":                       RateLimitMovies,
+	"GET /movies/{movie_id}":            RateLimitMovies,
+	"GET /movies/{movie_id}/characters": RateLimitMovies,
+}
+
+// RateLimit is a token bucket holding up to Requests tokens, refilled at Requests per Per. a zero RateLimit lets everything through
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l RateLimit) disabled() bool {
+	return l.Requests <= 0 || l.Per <= 0
+}
+
+// tokens added to the bucket every millisecond
+func (l RateLimit) ratePerMs() float64 {
+	return float64(l.Requests) / float64(l.Per.Milliseconds())
+}
+
+// RateLimitResult is what a RateLimiter decided for one request
+type RateLimitResult struct {
+	Allowed bool
+	Limit   int
+	// whole tokens left in the bucket
+	Remaining int
+	// how long until the bucket is full again
+	Reset time.Duration
+	// how long until the next request would be allowed, only set when this one wasn't
+	RetryAfter time.Duration
+}
+
+// RateLimiter takes a token from the bucket stored under key
+type RateLimiter interface {
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// NewRateLimiter builds the limiter matching config.CacheBackend, buckets live in redis so every instance shares them,
+// or in memory when the api runs without redis
+func NewRateLimiter(config Config, redisClient *redis.Client) (RateLimiter, error) {
+	switch config.CacheBackend {
+	case "", "redis":
+		if redisClient == nil {
+			return nil, fmt.Errorf("redis rate limiter requires a redis client")
+		}
+		return NewRedisRateLimiter(redisClient), nil
+	case "memory":
+		return NewMemoryRateLimiter(), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", config.CacheBackend)
+	}
+}
+
+// rateLimitResult works out the headers for a bucket left holding tokens
+func rateLimitResult(limit RateLimit, tokens float64, allowed bool) RateLimitResult {
+	rate := limit.ratePerMs()
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit.Requests,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration(math.Ceil((float64(limit.Requests)-tokens)/rate)) * time.Millisecond,
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration(math.Ceil((1-tokens)/rate)) * time.Millisecond
+	}
+	return result
+}
+
+// the bucket is refilled and a token taken in one go so concurrent requests from other instances can't both get the last token.
+// buckets expire once they would be full again, a missing bucket is a full one
+var tokenBucketScript = redis.NewScript(`
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate)
+	ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call("HMSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(ts))
+redis.call("PEXPIRE", KEYS[1], math.ceil((capacity - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisRateLimiter keeps token buckets in redis
+type RedisRateLimiter struct {
+	client *redis.Client
+}
+
+func NewRedisRateLimiter(client *redis.Client) *RedisRateLimiter {
+	return &RedisRateLimiter{client: client}
+}
+
+func (l *RedisRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	now := time.Now().UnixMilli()
+	reply, err := tokenBucketScript.Run(ctx, l.client, []string{key}, limit.Requests, limit.ratePerMs(), now).Result()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return RateLimitResult{}, fmt.Errorf("unexpected rate limit reply %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	tokensValue, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(tokensValue, 64)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return rateLimitResult(limit, tokens, allowed == 1), nil
+}
+
+// MemoryRateLimiter keeps token buckets in process, limits are per instance
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	// when tokens was last worked out
+	updatedAt time.Time
+	// when the bucket is full again and can be forgotten
+	fullAt time.Time
+}
+
+// past this many buckets the full ones are dropped
+const memoryRateLimiterSweep = 10000
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *MemoryRateLimiter) Take(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) > memoryRateLimiterSweep {
+		for bucketKey, bucket := range l.buckets {
+			if now.After(bucket.fullAt) {
+				delete(l.buckets, bucketKey)
+			}
+		}
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok || now.After(bucket.fullAt) {
+		bucket = &tokenBucket{tokens: float64(limit.Requests), updatedAt: now}
+		l.buckets[key] = bucket
+	}
+	rate := limit.ratePerMs()
+	elapsed := float64(now.Sub(bucket.updatedAt).Milliseconds())
+	bucket.tokens = math.Min(float64(limit.Requests), bucket.tokens+elapsed*rate)
+	bucket.updatedAt = now
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	result := rateLimitResult(limit, bucket.tokens, allowed)
+	bucket.fullAt = now.Add(result.Reset)
+	return result, nil
+}
+
+// rateLimitIdentity is who a request is counted against, the api key it was authenticated with and its ip otherwise.
+// a key that hasn't been validated counts for nothing, or a client could get a fresh bucket by making up a key per request
+func rateLimitIdentity(r *http.Request) string {
+	if key := APIKeyFromContext(r.Context()); key != nil {
+		return "key:" + strconv.Itoa(key.ID)
+	}
+	return "ip:" + clientIP(r)
+}
+
+// rateLimitGroup is the group of the route r matched
+func rateLimitGroup(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return RateLimitDefault
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return RateLimitDefault
+	}
+	if group, ok := rateLimitGroups[r.Method+" "+template]; ok {
+		return group
+	}
+	return RateLimitDefault
+}
+
+// rateLimit is middleware taking a token from the bucket of the request's identity and route group,
+// requests are turned away with a 429 once the bucket is empty. requests are let through when the limiter is unavailable
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := rateLimitGroup(r)
+		limit := GetConfig().RateLimits[group]
+		if rateLimiter == nil || limit.disabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		result, err := rateLimiter.Take(r.Context(), fmt.Sprintf("ratelimit:%s:%s", group, rateLimitIdentity(r)), limit)
+		if err != nil {
+			log.Printf("failed to check rate limit: %s", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Requests, ceilSeconds(limit.Per)))
+		if !result.Allowed {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			utils.Dispatch429Error(w, "too many requests", map[string]string{"group": group})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ceilSeconds rounds d up to whole seconds, as rate limit headers expect
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
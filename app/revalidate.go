@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CacheStatus tells a client where the data in a response came from
+type CacheStatus string
+
+const (
+	// served from the cache within its ttl
+	CacheFresh CacheStatus = "fresh"
+	// served from the cache after its ttl, a background refresh has been started
+	CacheStale CacheStatus = "stale"
+	// fetched from the movie provider for this request
+	CacheOrigin CacheStatus = "origin"
+)
+
+const cacheStatusHeader = "X-Cache-Status"
+
+// keys currently being refreshed in the background, so a burst of stale reads only triggers one refresh
+var revalidating sync.Map
+
+// cachedEntry wraps every value written by writeCached so readers can tell when it went stale
+type cachedEntry struct {
+	Value      json.RawMessage `json:"value"`
+	FreshUntil time.Time       `json:"fresh_until,omitempty"`
+}
+
+// readCached decodes the value under key into v and reports whether it was found and whether it is past its ttl
+func readCached(ctx context.Context, key string, v interface{}) (found bool, stale bool, err error) {
+	content, found, err := movieCache.Get(ctx, key)
+	if err != nil || !found {
+		return false, false, err
+	}
+
+	var entry cachedEntry
+	if err := json.Unmarshal(content, &entry); err != nil || len(entry.Value) == 0 {
+		// written before entries carried a ttl, serve it but have it refreshed
+		if err := json.Unmarshal(content, v); err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	}
+	if err := json.Unmarshal(entry.Value, v); err != nil {
+		return false, false, err
+	}
+	stale = !entry.FreshUntil.IsZero() && time.Now().After(entry.FreshUntil)
+	return true, stale, nil
+}
+
+// writeCached stores v under key, it is fresh for ttl and kept for a further CacheStaleTTL after that. a ttl of 0 never goes stale
+func writeCached(ctx context.Context, key string, v interface{}, ttl time.Duration) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	entry := cachedEntry{Value: value}
+	var expiration time.Duration
+	if ttl > 0 {
+		entry.FreshUntil = time.Now().Add(ttl)
+		if staleTTL := GetConfig().CacheStaleTTL; staleTTL > 0 {
+			expiration = ttl + staleTTL
+		}
+	}
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return movieCache.Set(ctx, key, content, expiration)
+}
+
+// revalidate runs refresh in the background unless a refresh of key is already running
+func revalidate(key string, refresh func(ctx context.Context) error) {
+	if _, running := revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	go func() {
+		defer revalidating.Delete(key)
+		// the request that noticed the stale entry is long gone by now, so don't tie the refresh to it
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamCallTimeout(GetConfig()))
+		defer cancel()
+		if err := refresh(ctx); err != nil {
+			log.Printf("failed to refresh cached %s: %s", key, err)
+		}
+	}()
+}
+
+// mergeCacheStatus combines the status of several lookups, stale wins over origin which wins over fresh
+func mergeCacheStatus(a, b CacheStatus) CacheStatus {
+	rank := map[CacheStatus]int{"": 0, CacheFresh: 1, CacheOrigin: 2, CacheStale: 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+func setCacheStatus(w http.ResponseWriter, status CacheStatus) {
+	if status != "" {
+		w.Header().Set(cacheStatusHeader, string(status))
+	}
+}
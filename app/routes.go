@@ -1,46 +1,80 @@
 package app
 
 import (
-	"context"
 	"log"
 	"net/http"
 
-	"github.com/go-redis/redis"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/showbaba/movies-api/data"
 )
 
 var (
-	ctx    = context.Background()
-	models *data.Models
-	redisClient  *redis.Client
+	models        *data.Models
+	movieCache    Cache
+	movieProvider MovieProvider
+	rateLimiter   RateLimiter
+	ipPrivacy     *IPPrivacy
 )
 
-func (a *App) Initialize(dbModels *data.Models, redisCLient *redis.Client) {
+func (a *App) Initialize(dbModels *data.Models, cache Cache, provider MovieProvider, limiter RateLimiter, privacy *IPPrivacy) {
 	a.Router = mux.NewRouter()
 	a.setRouters()
+	// authenticate goes first so requests made with an api key are counted against the key once it has been validated
+	a.Router.Use(authenticate, rateLimit)
 	models = dbModels
-	redisClient = redisCLient
+	movieCache = cache
+	movieProvider = provider
+	rateLimiter = limiter
+	ipPrivacy = privacy
+	commentFilters = newCommentFilters(GetConfig())
 }
 
 func (a *App) setRouters() {
 	a.Get("/ping", Ping)
+	a.Get("/stats/coalescing", FetchCoalescingStats)
+	a.Post("/auth/register", Register)
+	a.Post("/auth/login", Login)
+	a.Post("/auth/refresh", RefreshToken)
+	a.Post("/auth/logout", Logout)
+	a.Get("/auth/me", requireUser(FetchCurrentUser))
 	a.Post("/movies/{movie_id}/comment", AddComment)
 	a.Get("/movies", FetchMovies)
 	a.Get("/movies/{movie_id}", FetchMovie)
 	a.Get("/movies/{movie_id}/characters", FetchMovieCharacters)
+	a.Get("/movies/{movie_id}/comments", FetchMovieComments)
+	a.Delete("/cache/movies/{movie_id}", EvictMovie)
+	a.Get("/comments/{id}", FetchComment)
+	a.Patch("/comments/{id}", UpdateComment)
+	a.Delete("/comments/{id}", DeleteComment)
+	a.Post("/comments/{id}/reactions", AddReaction)
+	a.Delete("/comments/{id}/reactions", RemoveReaction)
+	a.Post("/comments/{id}/flag", FlagComment)
+	a.Get("/admin/comments", FetchModerationQueue)
+	a.Post("/admin/comments/{id}/approve", ApproveComment)
+	a.Post("/admin/comments/{id}/reject", RejectComment)
+	a.Get("/admin/api-keys", FetchAPIKeys)
+	a.Post("/admin/api-keys", CreateAPIKey)
+	a.Delete("/admin/api-keys/{id}", RevokeAPIKey)
+	a.Patch("/admin/users/{id}/role", SetUserRole)
 }
 
-// handler method
+// handler method, every route is checked against its entry in policies
 func (a *App) Post(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.Router.HandleFunc(path, f).Methods("Post")
+	a.Router.HandleFunc(path, authorize(http.MethodPost, path, f)).Methods("Post")
 }
 
 func (a *App) Get(path string, f func(w http.ResponseWriter, r *http.Request)) {
-	a.Router.HandleFunc(path, f).Methods("Get")
+	a.Router.HandleFunc(path, authorize(http.MethodGet, path, f)).Methods("Get")
 }
 
+func (a *App) Patch(path string, f func(w http.ResponseWriter, r *http.Request)) {
+	a.Router.HandleFunc(path, authorize(http.MethodPatch, path, f)).Methods("Patch")
+}
+
+func (a *App) Delete(path string, f func(w http.ResponseWriter, r *http.Request)) {
+	a.Router.HandleFunc(path, authorize(http.MethodDelete, path, f)).Methods("Delete")
+}
 
 // run
 func (a *App) Run(host string) {
@@ -50,8 +84,9 @@ func (a *App) Run(host string) {
 			host,
 			handlers.CORS(
 				handlers.AllowCredentials(),
-				handlers.AllowedMethods([]string{"POST", "GET", "PUT", "OPTIONS"}),
-				handlers.AllowedHeaders([]string{"Authorization", "Content-Type"}),
+				handlers.AllowedMethods([]string{"POST", "GET", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+				handlers.AllowedHeaders([]string{"Authorization", "Content-Type", "X-Admin-Token"}),
+				handlers.ExposedHeaders([]string{"Retry-After", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "X-Cache-Status", "WWW-Authenticate"}),
 				handlers.MaxAge(3600),
 			)(a.Router),
 		),
@@ -0,0 +1,40 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/showbaba/movies-api/data"
+	"github.com/showbaba/movies-api/utils"
+)
+
+// OpenModels opens the database of the comment store selected by config.CommentStore, migrated to the latest schema,
+// and returns the repositories of it. accounts and api keys are kept next to the comments, in a private in-memory
+// sqlite database for the memory store, so only the postgres store needs postgres
+func OpenModels(config Config) (data.Models, *sql.DB, error) {
+	switch config.CommentStore {
+	case "", "postgres":
+		db := utils.ConnectToSQLDB(config.DbHost, config.DbUser, config.DbPassword, config.DbName, config.DbPort)
+		if _, err := data.MigrateUp(db); err != nil {
+			db.Close()
+			return data.Models{}, nil, err
+		}
+		return data.New(db), db, nil
+	case "sqlite":
+		db, err := data.OpenSQLite(config.CommentStorePath)
+		if err != nil {
+			return data.Models{}, nil, err
+		}
+		return data.NewSQLite(db), db, nil
+	case "memory":
+		db, err := data.OpenSQLite("")
+		if err != nil {
+			return data.Models{}, nil, err
+		}
+		models := data.NewSQLite(db)
+		models.Comments = data.NewMemoryCommentRepository()
+		return models, db, nil
+	default:
+		return data.Models{}, nil, fmt.Errorf("unknown comment store %q", config.CommentStore)
+	}
+}
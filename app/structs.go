@@ -10,18 +10,69 @@ type App struct {
 }
 
 type CreateCommentPayload struct {
-	Body         string `json:"body" validate:"required"`
-	UserPublicIP string `json:"user_public_ip" validate:"required"`
+	Body string `json:"body" validate:"required"`
+	// ignored, the author is identified by the address the request came from (see clientIP)
+	UserPublicIP string `json:"user_public_ip"`
+	// set to reply to another comment on the same movie
+	ParentID *int `json:"parent_id"`
+}
+
+type UpdateCommentPayload struct {
+	Body string `json:"body" validate:"required"`
+	// ignored like CreateCommentPayload.UserPublicIP
+	UserPublicIP string `json:"user_public_ip"`
+}
+
+type ReactionPayload struct {
+	// upvote, downvote or one of the emojis in Config.ReactionEmojis
+	Reaction string `json:"reaction" validate:"required"`
+	// ignored, voters are told apart by the address the request came from
+	UserPublicIP string `json:"user_public_ip"`
+}
+
+type FlagCommentPayload struct {
+	// ignored, as for reactions
+	UserPublicIP string `json:"user_public_ip"`
+	Reason       string `json:"reason" validate:"max=255"`
+}
+
+type RegisterPayload struct {
+	Username string `json:"username" validate:"required,alphanum,min=3,max=50"`
+	// bcrypt only looks at the first 72 bytes
+	Password string `json:"password" validate:"required,min=8,max=72"`
+}
+
+type LoginPayload struct {
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type RefreshTokenPayload struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+type CreateAPIKeyPayload struct {
+	Name   string   `json:"name" validate:"required,max=100"`
+	Scopes []string `json:"scopes" validate:"required,min=1,dive,oneof=movies:read comments:write cache:admin"`
+}
+
+type SetRolePayload struct {
+	Role string `json:"role" validate:"required,oneof=reader commenter moderator admin"`
 }
 
 type Movie struct {
-	ID           interface{}
-	Title        string   `json:"title"`
-	OpeningCrawl string   `json:"opening_crawl"`
+	// canonical id of the movie, the trailing number of its swapi url (see filmIDFromURL)
+	ID           string          `json:"id"`
+	Title        string          `json:"title"`
+	EpisodeID    int             `json:"episode_id"`
+	OpeningCrawl string          `json:"opening_crawl"`
 	Comments     []*data.Comment `json:"comments"`
-	CommentCount int `json:"comments_count"`
-	ReleaseDate  string `json:"release_date"`
-	Characters []string `json:"characters"`
+	CommentCount int             `json:"comments_count"`
+	// highest scoring comment of the movie, if any has a positive score
+	TopComment  *data.Comment `json:"top_comment"`
+	ReleaseDate string        `json:"release_date"`
+	Characters  []string      `json:"characters"`
+	URL         string        `json:"url"`
 }
 
 type Character struct {
@@ -31,6 +82,6 @@ type Character struct {
 }
 
 type MovieTitleWithID struct {
-    Title string `json:"title"`
-    ID    string `json:"id"`
-}
\ No newline at end of file
+	Title string `json:"title"`
+	ID    string `json:"id"`
+}
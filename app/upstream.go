@@ -0,0 +1,273 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/showbaba/movies-api/utils"
+)
+
+const (
+	// longest wait between two attempts of a request, however many attempts came before
+	upstreamMaxBackoff = 5 * time.Second
+	// how long a call may take through every attempt when SWAPI_TIMEOUT doesn't bound the attempts
+	upstreamUnboundedCallTimeout = 30 * time.Second
+)
+
+// upstreamUnavailableError is returned instead of calling an upstream whose circuit breaker is open,
+// or once the upstream kept failing through every retry
+type upstreamUnavailableError struct {
+	host   string
+	reason string
+	// how long until the breaker lets requests through again, 0 when unknown
+	retryAfter time.Duration
+}
+
+func (e *upstreamUnavailableError) Error() string {
+	return fmt.Sprintf("upstream %s is unavailable: %s", e.host, e.reason)
+}
+
+// UpstreamTransport is the http.RoundTripper of the SWAPI client. every attempt runs under its own timeout,
+// idempotent requests that fail are retried with jittered exponential backoff, and every host has a circuit breaker
+// that stops calling it after too many failures in a row
+type UpstreamTransport struct {
+	base http.RoundTripper
+	// how long a single attempt may take, 0 leaves it to the context of the request
+	attemptTimeout time.Duration
+	// attempts made after the first one has failed
+	retries int
+	// the ceiling of the wait before the first retry, doubled for every retry after it
+	backoff time.Duration
+	// failures in a row that open a breaker, 0 turns the breakers off
+	breakerFailures int
+	// how long an open breaker rejects requests before it lets a probe through
+	breakerCooldown time.Duration
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+	random   *rand.Rand
+}
+
+func NewUpstreamTransport(config Config, base http.RoundTripper) *UpstreamTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &UpstreamTransport{
+		base:            base,
+		attemptTimeout:  config.SwapiTimeout,
+		retries:         config.SwapiRetries,
+		backoff:         config.SwapiRetryBackoff,
+		breakerFailures: config.SwapiBreakerFailures,
+		breakerCooldown: config.SwapiBreakerCooldown,
+		breakers:        make(map[string]*circuitBreaker),
+		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (t *UpstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := t.breaker(req.URL.Host)
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	for attempt := 0; ; attempt++ {
+		probe, err := breaker.allow()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.attempt(req)
+		failed := err != nil || retryableStatus(resp.StatusCode)
+		if req.Context().Err() != nil {
+			// the caller gave up, which says nothing about the upstream
+			breaker.abandon(probe)
+			return resp, err
+		}
+		breaker.record(probe, !failed)
+		if !failed || !idempotent || attempt >= t.retries {
+			if err != nil {
+				// the upstream couldn't be reached at all, which is what callers fall back on stale data for
+				return nil, &upstreamUnavailableError{host: req.URL.Host, reason: err.Error()}
+			}
+			return resp, nil
+		}
+
+		if resp != nil {
+			// drain what is left of the body so the connection can be reused
+			io.CopyN(io.Discard, resp.Body, 4096)
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(t.backoffFor(attempt))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// attempt sends req once, under the attempt timeout which lasts until the body of the response is closed
+func (t *UpstreamTransport) attempt(req *http.Request) (*http.Response, error) {
+	if t.attemptTimeout <= 0 {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.attemptTimeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// backoffFor picks the wait after the given attempt at random between 0 and backoff * 2^attempt, so clients that
+// failed together don't retry together
+func (t *UpstreamTransport) backoffFor(attempt int) time.Duration {
+	ceiling := backoffCeiling(t.backoff, attempt)
+	if ceiling <= 0 {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Duration(t.random.Int63n(int64(ceiling)))
+}
+
+// backoffCeiling is the longest wait after the given attempt
+func backoffCeiling(backoff time.Duration, attempt int) time.Duration {
+	if attempt < 30 && backoff<<attempt < upstreamMaxBackoff {
+		return backoff << attempt
+	}
+	return upstreamMaxBackoff
+}
+
+// upstreamCallTimeout is how long a call to the movie provider may take through every attempt and the waits between
+// them, plus caching what it fetched. it bounds the calls that outlive the request which started them
+func upstreamCallTimeout(config Config) time.Duration {
+	if config.SwapiTimeout <= 0 {
+		return upstreamUnboundedCallTimeout
+	}
+	timeout := config.SwapiTimeout*time.Duration(config.SwapiRetries+1) + config.RedisTimeout
+	for attempt := 0; attempt < config.SwapiRetries; attempt++ {
+		timeout += backoffCeiling(config.SwapiRetryBackoff, attempt)
+	}
+	return timeout
+}
+
+func (t *UpstreamTransport) breaker(host string) *circuitBreaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	breaker, ok := t.breakers[host]
+	if !ok {
+		breaker = &circuitBreaker{host: host, failures: t.breakerFailures, cooldown: t.breakerCooldown}
+		t.breakers[host] = breaker
+	}
+	return breaker
+}
+
+// retryableStatus reports whether a response with status says the upstream is struggling rather than that the request is wrong
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError && status != http.StatusNotImplemented
+}
+
+// cancelOnClose releases the context of an attempt once its response has been read
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// circuitBreaker counts the failures in a row of a host. it is closed while there are fewer than failures of them,
+// then open for cooldown, rejecting every request, and then half-open, letting one probe request through at a time
+// whose outcome closes or opens it again
+type circuitBreaker struct {
+	host     string
+	failures int
+	cooldown time.Duration
+
+	mu sync.Mutex
+	// failures in a row so far
+	failed int
+	// zero while closed
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a request may go through, and whether it is the probe of a half-open breaker
+func (b *circuitBreaker) allow() (bool, error) {
+	if b.failures <= 0 {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return false, nil
+	}
+	if wait := time.Until(b.openUntil); wait > 0 {
+		return false, &upstreamUnavailableError{host: b.host, reason: "circuit breaker is open", retryAfter: wait}
+	}
+	if b.probing {
+		return false, &upstreamUnavailableError{host: b.host, reason: "circuit breaker is half-open and already probing"}
+	}
+	b.probing = true
+	return true, nil
+}
+
+// record counts the outcome of a request allowed through
+func (b *circuitBreaker) record(probe, success bool) {
+	if b.failures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if success {
+		if !b.openUntil.IsZero() {
+			log.Printf("circuit breaker for %s closed", b.host)
+		}
+		b.failed = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failed++
+	if probe || b.failed >= b.failures {
+		if b.openUntil.IsZero() {
+			log.Printf("circuit breaker for %s opened after %d failures in a row", b.host, b.failed)
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// abandon lets another request probe in place of a probe whose caller gave up
+func (b *circuitBreaker) abandon(probe bool) {
+	if !probe {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// dispatchUpstreamError answers 503 when err is the movie provider being unavailable, see utils.DispatchServerError otherwise
+func dispatchUpstreamError(w http.ResponseWriter, err error) {
+	var unavailable *upstreamUnavailableError
+	if !errors.As(err, &unavailable) {
+		utils.DispatchServerError(w, err)
+		return
+	}
+	if unavailable.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(unavailable.retryAfter)))
+	}
+	utils.Dispatch503Error(w, "the movie catalogue is unavailable, try again later", err.Error())
+}
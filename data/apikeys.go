@@ -0,0 +1,126 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// APIKey lets a service call the api, only a hash of the key itself is stored
+type APIKey struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// first characters of the key, enough to recognise it in a list
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// APIKeyRepository stores api keys
+type APIKeyRepository struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+func NewAPIKeyRepository(db *sql.DB) *APIKeyRepository {
+	return &APIKeyRepository{db: db, dialect: postgresDialect}
+}
+
+const apiKeyColumns = `id, name, prefix, key_hash, scopes, created_at, last_used_at, revoked_at`
+
+// scan reads the apiKeyColumns of row, followed by the columns of extra
+func (r *APIKeyRepository) scan(row rowScanner, extra ...interface{}) (*APIKey, error) {
+	var key APIKey
+	dest := []interface{}{&key.ID, &key.Name, &key.Prefix, &key.KeyHash, r.dialect.textArray(&key.Scopes), &key.CreatedAt, &key.LastUsedAt, &key.RevokedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+/*
+store a new api key
+*/
+func (r *APIKeyRepository) Insert(ctx context.Context, k *APIKey) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	k.CreatedAt = r.dialect.timeArg(time.Now())
+	query := `INSERT INTO api_keys (name, prefix, key_hash, scopes, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	if err := r.db.QueryRowContext(ctx, query, k.Name, k.Prefix, k.KeyHash, r.dialect.textArray(&k.Scopes), k.CreatedAt).Scan(&k.ID); err != nil {
+		return 0, err
+	}
+	return k.ID, nil
+}
+
+// how precisely the last use of a key is recorded, writing it down on every request would make each of them a write
+const apiKeyUseResolution = time.Minute
+
+/*
+fetch the api key with keyHash and record that it was used, returns nil if there is no such key or it has been revoked.
+the time of the last use is only written when the recorded one is older than apiKeyUseResolution
+*/
+func (r *APIKeyRepository) Use(ctx context.Context, keyHash string) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	now := r.dialect.timeArg(time.Now())
+	// whether the recorded use is too old is worked out by the database, which stored it
+	query := `SELECT ` + apiKeyColumns + `, (last_used_at IS NULL OR last_used_at < $2) FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL`
+	var outdated bool
+	key, err := r.scan(r.db.QueryRowContext(ctx, query, keyHash, now.Add(-apiKeyUseResolution)), &outdated)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if outdated {
+		query := `UPDATE api_keys SET last_used_at = $2 WHERE id = $1`
+		if _, err := r.db.ExecContext(ctx, query, key.ID, now); err != nil {
+			return nil, err
+		}
+		key.LastUsedAt = &now
+	}
+	return key, nil
+}
+
+/*
+list every api key, revoked ones included, newest first
+*/
+func (r *APIKeyRepository) List(ctx context.Context) ([]*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := r.db.QueryContext(ctx, `SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created_at DESC, id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := r.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+/*
+revoke the api key with id, returns nil if there is no such key. revoking a revoked key keeps its first revocation time
+*/
+func (r *APIKeyRepository) Revoke(ctx context.Context, id int) (*APIKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	query := `UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $2) WHERE id = $1 RETURNING ` + apiKeyColumns
+	key, err := r.scan(r.db.QueryRowContext(ctx, query, id, r.dialect.timeArg(time.Now())))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return key, nil
+}
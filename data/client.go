@@ -5,17 +5,28 @@ import (
 	"time"
 )
 
-var db *sql.DB
+// how long a single query may run, on top of whatever deadline the caller's context has
+var dbTimeout = time.Second * 3
 
-const dbTimeout = time.Second * 3
+// SetQueryTimeout changes how long a single query may run, a timeout of 0 or less keeps the current one
+func SetQueryTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		dbTimeout = timeout
+	}
+}
 
 type Models struct {
-	Comment Comment
+	Comments      CommentRepository
+	Users         *UserRepository
+	APIKeys       *APIKeyRepository
+	RefreshTokens *RefreshTokenRepository
 }
 
 func New(dbPool *sql.DB) Models {
-	db = dbPool
 	return Models{
-		Comment: Comment{},
+		Comments:      NewPostgresCommentRepository(dbPool),
+		Users:         NewUserRepository(dbPool),
+		APIKeys:       NewAPIKeyRepository(dbPool),
+		RefreshTokens: NewRefreshTokenRepository(dbPool),
 	}
 }
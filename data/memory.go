@@ -0,0 +1,589 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryCommentRepository is a CommentRepository keeping everything in process, for tests and demos.
+// it answers every query the way SQLCommentRepository does
+type MemoryCommentRepository struct {
+	mu    *sync.Mutex
+	state *memoryState
+	// set on the copies handed to WithTx callbacks, which already hold mu
+	inTx bool
+}
+
+type memoryState struct {
+	lastID    int
+	comments  map[int]*Comment
+	deletedAt map[int]time.Time
+	// voter -> reactions given, by comment id
+	reactions map[int]map[string]map[string]bool
+	// flagger -> reason, by comment id
+	flags map[int]map[string]string
+}
+
+func NewMemoryCommentRepository() *MemoryCommentRepository {
+	return &MemoryCommentRepository{
+		mu: &sync.Mutex{},
+		state: &memoryState{
+			comments:  map[int]*Comment{},
+			deletedAt: map[int]time.Time{},
+			reactions: map[int]map[string]map[string]bool{},
+			flags:     map[int]map[string]string{},
+		},
+	}
+}
+
+// clone copies the state deep enough that changing the copy leaves s as it was
+func (s *memoryState) clone() *memoryState {
+	clone := &memoryState{
+		lastID:    s.lastID,
+		comments:  make(map[int]*Comment, len(s.comments)),
+		deletedAt: make(map[int]time.Time, len(s.deletedAt)),
+		reactions: make(map[int]map[string]map[string]bool, len(s.reactions)),
+		flags:     make(map[int]map[string]string, len(s.flags)),
+	}
+	for id, comment := range s.comments {
+		clone.comments[id] = copyComment(comment)
+	}
+	for id, deletedAt := range s.deletedAt {
+		clone.deletedAt[id] = deletedAt
+	}
+	for id, voters := range s.reactions {
+		clone.reactions[id] = make(map[string]map[string]bool, len(voters))
+		for voter, given := range voters {
+			clone.reactions[id][voter] = make(map[string]bool, len(given))
+			for reaction := range given {
+				clone.reactions[id][voter][reaction] = true
+			}
+		}
+	}
+	for id, flaggers := range s.flags {
+		clone.flags[id] = make(map[string]string, len(flaggers))
+		for flagger, reason := range flaggers {
+			clone.flags[id][flagger] = reason
+		}
+	}
+	return clone
+}
+
+// copyComment is what the repository hands out or keeps, so callers changing a comment don't change the store
+func copyComment(comment *Comment) *Comment {
+	copied := *comment
+	copied.Reactions = make(ReactionCounts, len(comment.Reactions))
+	for reaction, count := range comment.Reactions {
+		copied.Reactions[reaction] = count
+	}
+	return &copied
+}
+
+func (r *MemoryCommentRepository) lock() {
+	if !r.inTx {
+		r.mu.Lock()
+	}
+}
+
+func (r *MemoryCommentRepository) unlock() {
+	if !r.inTx {
+		r.mu.Unlock()
+	}
+}
+
+// WithTx runs f against a copy of the store which replaces it when f returns nil. the store is locked meanwhile, so
+// units of work run one at a time
+func (r *MemoryCommentRepository) WithTx(ctx context.Context, f func(repo CommentRepository) error) error {
+	if r.inTx {
+		return f(r)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tx := &MemoryCommentRepository{mu: r.mu, state: r.state.clone(), inTx: true}
+	if err := f(tx); err != nil {
+		return err
+	}
+	r.state = tx.state
+	return nil
+}
+
+// visible tells whether the comment with id is there and not deleted
+func (r *MemoryCommentRepository) visible(id int) bool {
+	_, deleted := r.state.deletedAt[id]
+	_, ok := r.state.comments[id]
+	return ok && !deleted
+}
+
+// sortKey is the key comment is ordered by for sortBy (the created_at column when sorting by date, as with sqlDialect.sortKey)
+// and whether the order is descending
+func memorySortKey(sortBy string, comment *Comment) (key float64, byDate bool, descending bool) {
+	switch sortBy {
+	case SortOldest:
+		return 0, true, false
+	case SortScore:
+		return float64(comment.Score), false, true
+	case SortHot:
+		return hotRank(comment.Score, comment.CreatedAt), false, true
+	default:
+		return 0, true, true
+	}
+}
+
+// compareComments orders a before b (-1), after it (1) or level with it (0) by sortBy key then id, ascending
+func compareComments(sortBy string, a *Comment, aKey float64, b *Comment, bKey float64) int {
+	_, byDate, _ := memorySortKey(sortBy, a)
+	switch {
+	case byDate && a.CreatedAt.Before(b.CreatedAt), !byDate && aKey < bKey:
+		return -1
+	case byDate && a.CreatedAt.After(b.CreatedAt), !byDate && aKey > bKey:
+		return 1
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+// sorted returns copies of the comments picked by keep in sortBy order, along with their sort keys
+func (r *MemoryCommentRepository) sorted(sortBy string, keep func(comment *Comment) bool) ([]*Comment, []float64) {
+	var comments []*Comment
+	for id, comment := range r.state.comments {
+		if r.visible(id) && keep(comment) {
+			comments = append(comments, copyComment(comment))
+		}
+	}
+	keys := make(map[int]float64, len(comments))
+	for _, comment := range comments {
+		keys[comment.ID], _, _ = memorySortKey(sortBy, comment)
+	}
+	_, _, descending := memorySortKey(sortBy, &Comment{})
+	sort.Slice(comments, func(i, j int) bool {
+		order := compareComments(sortBy, comments[i], keys[comments[i].ID], comments[j], keys[comments[j].ID])
+		if descending {
+			return order > 0
+		}
+		return order < 0
+	})
+	sortedKeys := make([]float64, len(comments))
+	for i, comment := range comments {
+		sortedKeys[i] = keys[comment.ID]
+	}
+	return comments, sortedKeys
+}
+
+/*
+fetch the approved comments of movieID ordered by sortBy (one of the Sort constants, newest first when empty)
+*/
+func (r *MemoryCommentRepository) Fetch(ctx context.Context, movieID string, sortBy string) ([]*Comment, error) {
+	r.lock()
+	defer r.unlock()
+	comments, _ := r.sorted(sortBy, func(comment *Comment) bool {
+		return comment.MovieID == movieID && comment.Status == StatusApproved
+	})
+	return comments, nil
+}
+
+/*
+fetch a page of comments using keyset pagination on (sort key, id), so pages stay stable while comments are added
+*/
+func (r *MemoryCommentRepository) FetchPage(ctx context.Context, query CommentPageQuery) (*CommentPage, error) {
+	if query.Sort == "" {
+		query.Sort = SortNewest
+	}
+	backwards := query.Before != nil
+	cursor := query.After
+	if backwards {
+		cursor = query.Before
+	}
+	if cursor != nil && cursor.Sort != "" && cursor.Sort != query.Sort {
+		return nil, ErrInvalidCursor
+	}
+	statuses := query.Statuses
+	if len(statuses) == 0 {
+		statuses = []string{StatusApproved}
+	}
+
+	r.lock()
+	defer r.unlock()
+	comments, keys := r.sorted(query.Sort, func(comment *Comment) bool {
+		return hasStatus(comment, statuses) && (query.MovieID == "" || comment.MovieID == query.MovieID) &&
+			(!query.RootsOnly || comment.ParentID == nil)
+	})
+	if backwards {
+		for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
+			comments[i], comments[j] = comments[j], comments[i]
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+	// walk from the cursor in the direction of the page
+	_, _, descending := memorySortKey(query.Sort, &Comment{})
+	walked := []*Comment{}
+	walkedKeys := []float64{}
+	for i, comment := range comments {
+		if cursor != nil {
+			order := compareComments(query.Sort, comment, keys[i], &Comment{ID: cursor.ID, CreatedAt: cursor.CreatedAt}, cursor.Key)
+			if (descending != backwards && order >= 0) || (descending == backwards && order <= 0) {
+				continue
+			}
+		}
+		walked = append(walked, comment)
+		walkedKeys = append(walkedKeys, keys[i])
+		if len(walked) > query.Limit {
+			break
+		}
+	}
+	return newCommentPage(query, walked, walkedKeys), nil
+}
+
+func hasStatus(comment *Comment, statuses []string) bool {
+	for _, status := range statuses {
+		if comment.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+fetch a page of top level comments for a movie with all of their replies nested under them, as SQLCommentRepository.FetchThreads
+*/
+func (r *MemoryCommentRepository) FetchThreads(ctx context.Context, query CommentPageQuery) (*ThreadPage, error) {
+	query.RootsOnly = true
+	page, err := r.FetchPage(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lock()
+	defer r.unlock()
+	below := map[int]bool{}
+	for _, comment := range page.Comments {
+		below[comment.ID] = true
+	}
+	// every approved reply whose parent is below the page, found a generation at a time
+	var replies []*Comment
+	for found := true; found; {
+		found = false
+		for id, comment := range r.state.comments {
+			if below[id] || comment.ParentID == nil || !below[*comment.ParentID] || !r.visible(id) || comment.Status != StatusApproved {
+				continue
+			}
+			below[id] = true
+			replies = append(replies, copyComment(comment))
+			found = true
+		}
+	}
+	sort.Slice(replies, func(i, j int) bool {
+		return compareComments(SortOldest, replies[i], 0, replies[j], 0) < 0
+	})
+	return newThreadPage(page, replies), nil
+}
+
+/*
+fetch the approved comment count and up to latest of the newest comments of every movie in movieIDs,
+movies without comments get an empty summary
+*/
+func (r *MemoryCommentRepository) FetchSummaries(ctx context.Context, movieIDs []string, latest int) (map[string]*CommentSummary, error) {
+	r.lock()
+	defer r.unlock()
+	summaries := make(map[string]*CommentSummary, len(movieIDs))
+	for _, movieID := range movieIDs {
+		comments, _ := r.sorted(SortNewest, func(comment *Comment) bool {
+			return comment.MovieID == movieID && comment.Status == StatusApproved
+		})
+		summary := &CommentSummary{Count: len(comments), Latest: []*Comment{}}
+		for i, comment := range comments {
+			if i < latest {
+				summary.Latest = append(summary.Latest, comment)
+			}
+			// newest first, so the first of the highest scores wins ties as it does in sql
+			if comment.Score > 0 && (summary.Top == nil || comment.Score > summary.Top.Score) {
+				summary.Top = comment
+			}
+		}
+		summaries[movieID] = summary
+	}
+	return summaries, nil
+}
+
+/*
+fetch a single comment by id whatever its status, returns nil if it does not exist or has been deleted
+*/
+func (r *MemoryCommentRepository) GetByID(ctx context.Context, id int) (*Comment, error) {
+	r.lock()
+	defer r.unlock()
+	if !r.visible(id) {
+		return nil, nil
+	}
+	return copyComment(r.state.comments[id]), nil
+}
+
+/*
+create a new comment
+*/
+func (r *MemoryCommentRepository) Insert(ctx context.Context, c *Comment) (int, error) {
+	r.lock()
+	defer r.unlock()
+	if c.Status == "" {
+		c.Status = StatusApproved
+	}
+	if c.IPFormat == "" {
+		c.IPFormat = IPFormatRaw
+	}
+	r.state.lastID++
+	c.ID = r.state.lastID
+	c.Score, c.Reactions = 0, ReactionCounts{}
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	r.state.comments[c.ID] = copyComment(c)
+	return c.ID, nil
+}
+
+/*
+save the body and status of the comment, updated_at is set to the time of the edit.
+returns ErrCommentNotFound when the comment has been deleted
+*/
+func (r *MemoryCommentRepository) Update(ctx context.Context, c *Comment) error {
+	r.lock()
+	defer r.unlock()
+	if !r.visible(c.ID) {
+		return ErrCommentNotFound
+	}
+	stored := r.state.comments[c.ID]
+	stored.Body, stored.Status, stored.UpdatedAt = c.Body, c.Status, time.Now()
+	c.UpdatedAt = stored.UpdatedAt
+	return nil
+}
+
+/*
+soft delete the comment, it is kept but no longer returned by any fetch
+*/
+func (r *MemoryCommentRepository) Delete(ctx context.Context, c *Comment) error {
+	r.lock()
+	defer r.unlock()
+	if !r.visible(c.ID) {
+		return ErrCommentNotFound
+	}
+	r.state.deletedAt[c.ID] = time.Now()
+	return nil
+}
+
+/*
+add a reaction from voter to the comment, upvotes and downvotes cancel each other out as in SQLCommentRepository.AddReaction.
+returns ErrCommentNotFound when the comment has been deleted
+*/
+func (r *MemoryCommentRepository) AddReaction(ctx context.Context, c *Comment, voter, reaction string) error {
+	r.lock()
+	defer r.unlock()
+	if !r.visible(c.ID) {
+		return ErrCommentNotFound
+	}
+	if r.state.reactions[c.ID] == nil {
+		r.state.reactions[c.ID] = map[string]map[string]bool{}
+	}
+	if r.state.reactions[c.ID][voter] == nil {
+		r.state.reactions[c.ID][voter] = map[string]bool{}
+	}
+	delete(r.state.reactions[c.ID][voter], oppositeVote(reaction))
+	r.state.reactions[c.ID][voter][reaction] = true
+	r.refreshReactions(c)
+	return nil
+}
+
+/*
+remove a reaction voter gave to the comment, removing one that was never given is a no-op
+*/
+func (r *MemoryCommentRepository) RemoveReaction(ctx context.Context, c *Comment, voter, reaction string) error {
+	r.lock()
+	defer r.unlock()
+	delete(r.state.reactions[c.ID][voter], reaction)
+	r.refreshReactions(c)
+	return nil
+}
+
+// refreshReactions recomputes the score and reaction counts of the comment from the reactions given to it
+func (r *MemoryCommentRepository) refreshReactions(c *Comment) {
+	score, counts := 0, ReactionCounts{}
+	for _, given := range r.state.reactions[c.ID] {
+		for reaction := range given {
+			counts[reaction]++
+			switch reaction {
+			case ReactionUpvote:
+				score++
+			case ReactionDownvote:
+				score--
+			}
+		}
+	}
+	if stored, ok := r.state.comments[c.ID]; ok {
+		stored.Score, stored.Reactions = score, counts
+	}
+	c.Score, c.Reactions = score, ReactionCounts{}
+	for reaction, count := range counts {
+		c.Reactions[reaction] = count
+	}
+}
+
+/*
+record a flag from flagger against the comment, each flagger counts once.
+once threshold flaggers have flagged an approved comment it is moved to flagged.
+returns ErrCommentNotFound when the comment has been deleted
+*/
+func (r *MemoryCommentRepository) Flag(ctx context.Context, c *Comment, flagger, reason string, threshold int) error {
+	r.lock()
+	defer r.unlock()
+	if !r.visible(c.ID) {
+		return ErrCommentNotFound
+	}
+	if r.state.flags[c.ID] == nil {
+		r.state.flags[c.ID] = map[string]string{}
+	}
+	if _, ok := r.state.flags[c.ID][flagger]; !ok {
+		r.state.flags[c.ID][flagger] = reason
+	}
+	stored, ok := r.state.comments[c.ID]
+	if ok && stored.Status == StatusApproved && len(r.state.flags[c.ID]) >= threshold {
+		stored.Status = StatusFlagged
+		c.Status = StatusFlagged
+	}
+	return nil
+}
+
+/*
+set the status of the comment as a moderator. approving clears its flags, since a moderator has looked at them
+*/
+func (r *MemoryCommentRepository) Moderate(ctx context.Context, c *Comment, status string) error {
+	r.lock()
+	defer r.unlock()
+	if r.visible(c.ID) {
+		r.state.comments[c.ID].Status = status
+	}
+	if status == StatusApproved {
+		delete(r.state.flags, c.ID)
+	}
+	c.Status = status
+	return nil
+}
+
+/*
+fetch the distinct movie ids comments are attached to
+*/
+func (r *MemoryCommentRepository) MovieIDs(ctx context.Context) ([]string, error) {
+	r.lock()
+	defer r.unlock()
+	seen := map[string]bool{}
+	var movieIDs []string
+	for _, comment := range r.state.comments {
+		if !seen[comment.MovieID] {
+			seen[comment.MovieID] = true
+			movieIDs = append(movieIDs, comment.MovieID)
+		}
+	}
+	sort.Strings(movieIDs)
+	return movieIDs, nil
+}
+
+/*
+move comments from one movie id to another, mapping is old id -> new id. every comment is moved by the mapping at once
+*/
+func (r *MemoryCommentRepository) RemapMovieIDs(ctx context.Context, mapping map[string]string) (int64, error) {
+	r.lock()
+	defer r.unlock()
+	var updated int64
+	for _, comment := range r.state.comments {
+		if newID, ok := mapping[comment.MovieID]; ok && newID != comment.MovieID {
+			comment.MovieID = newID
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+/*
+give every comment without an author handle one, handle works it out from the stored address. returns how many comments were updated
+*/
+func (r *MemoryCommentRepository) FillAuthorHandles(ctx context.Context, handle func(storedIP string) string) (int, error) {
+	r.lock()
+	defer r.unlock()
+	updated := 0
+	for _, comment := range r.state.comments {
+		if comment.AuthorHandle == "" {
+			comment.AuthorHandle = handle(comment.UserPublicIP)
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+/*
+replace the raw addresses of comments created before cutoff with what protect makes of them, protect returns the new value and its IPFormat.
+returns how many comments were updated
+*/
+func (r *MemoryCommentRepository) PurgeRawIPs(ctx context.Context, cutoff time.Time, protect func(ip string) (string, string)) (int, error) {
+	r.lock()
+	defer r.unlock()
+	updated := 0
+	for _, comment := range r.state.comments {
+		if comment.IPFormat == IPFormatRaw && comment.CreatedAt.Before(cutoff) {
+			comment.UserPublicIP, comment.IPFormat = protect(comment.UserPublicIP)
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+/*
+replace the voters and flaggers still stored as an address (every one that isn't an account, an api key or already hashed)
+with IdentityAnonymousPrefix followed by what hash makes of the address. a row whose client already has the same row under
+the hashed identity is dropped instead. returns how many rows were rewritten or dropped
+*/
+func (r *MemoryCommentRepository) HashAnonymousIdentities(ctx context.Context, hash func(stored string) string) (int, error) {
+	r.lock()
+	defer r.unlock()
+	updated := 0
+	for id, voters := range r.state.reactions {
+		for voter, given := range voters {
+			if !isStoredAddress(voter) {
+				continue
+			}
+			identity := IdentityAnonymousPrefix + hash(voter)
+			if voters[identity] == nil {
+				voters[identity] = map[string]bool{}
+			}
+			for reaction := range given {
+				voters[identity][reaction] = true
+				updated++
+			}
+			delete(voters, voter)
+		}
+		r.refreshReactions(&Comment{ID: id})
+	}
+	for _, flaggers := range r.state.flags {
+		for flagger, reason := range flaggers {
+			if !isStoredAddress(flagger) {
+				continue
+			}
+			identity := IdentityAnonymousPrefix + hash(flagger)
+			if _, ok := flaggers[identity]; !ok {
+				flaggers[identity] = reason
+			}
+			delete(flaggers, flagger)
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+// isStoredAddress tells whether identity is an address rather than one of the identities
+func isStoredAddress(identity string) bool {
+	for _, prefix := range []string{IdentityUserPrefix, IdentityAPIKeyPrefix, IdentityAnonymousPrefix} {
+		if strings.HasPrefix(identity, prefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,12 @@
+package data_test
+
+import (
+	"testing"
+
+	"github.com/showbaba/movies-api/data"
+	"github.com/showbaba/movies-api/data/storetest"
+)
+
+func TestMemoryCommentRepository(t *testing.T) {
+	storetest.CheckCommentRepository(t, data.NewMemoryCommentRepository())
+}
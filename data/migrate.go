@@ -0,0 +1,284 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// the schema of each database, one numbered pair of files per change: NNNN_name.up.sql and NNNN_name.down.sql.
+// migrations are never edited once released, a change to the schema is a new migration in every directory under the same version
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrations can rewrite whole tables, so they get far longer than a query
+const migrationTimeout = time.Minute * 10
+
+// key of the advisory lock held while migrating, so instances starting together don't migrate the same database at once
+const migrationLockID = 7243501
+
+// migrationDialect is where the migrations of a database are and how it is locked while they run
+type migrationDialect struct {
+	dir string
+	// statements taking and releasing the migration lock with migrationLockID, empty for databases with a single user
+	lock, unlock string
+}
+
+var (
+	postgresMigrations = migrationDialect{
+		dir:    "migrations/postgres",
+		lock:   `SELECT pg_advisory_lock($1)`,
+		unlock: `SELECT pg_advisory_unlock($1)`,
+	}
+	sqliteMigrations = migrationDialect{dir: "migrations/sqlite"}
+)
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+type Migration struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Up      string `json:"-"`
+	Down    string `json:"-"`
+}
+
+type MigrationStatus struct {
+	Migration
+	// when the migration was applied, nil while it is pending
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// loadMigrations reads the embedded migrations in dir, ordered by version
+func loadMigrations(dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s is not named NNNN_name.up.sql or NNNN_name.down.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(migrationFiles, dir+"/"+entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d is named both %s and %s", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %04d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs f on a connection to db holding the migration lock, with the schema_migrations table in place
+func withMigrationLock(db *sql.DB, dialect migrationDialect, f func(ctx context.Context, conn *sql.Conn, migrations []Migration) error) error {
+	migrations, err := loadMigrations(dialect.dir)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), migrationTimeout)
+	defer cancel()
+	// advisory locks belong to a session, so everything has to go through the one connection
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if dialect.lock != "" {
+		if _, err := conn.ExecContext(ctx, dialect.lock, migrationLockID); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), dialect.unlock, migrationLockID)
+	}
+	if _, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)`); err != nil {
+		return err
+	}
+	return f(ctx, conn, migrations)
+}
+
+// appliedMigrations is when each applied migration was applied, by version
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies (or with up false, reverts) migration and records it, all in one transaction
+func runMigration(ctx context.Context, conn *sql.Conn, migration Migration, up bool) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	script, record, args := migration.Up, `INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`, []interface{}{migration.Version, migration.Name, time.Now()}
+	if !up {
+		script, record, args = migration.Down, `DELETE FROM schema_migrations WHERE version = $1`, []interface{}{migration.Version}
+	}
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", migration.Version, migration.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration in version order
+func migrateUp(ctx context.Context, conn *sql.Conn, migrations []Migration) ([]Migration, error) {
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	ran := []Migration{}
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+		if err := runMigration(ctx, conn, migration, true); err != nil {
+			return ran, err
+		}
+		log.Printf("applied migration %04d_%s", migration.Version, migration.Name)
+		ran = append(ran, migration)
+	}
+	return ran, nil
+}
+
+// migrateDown reverts the last steps applied migrations, newest first
+func migrateDown(ctx context.Context, conn *sql.Conn, migrations []Migration, steps int) ([]Migration, error) {
+	applied, err := appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	known := map[int]bool{}
+	for _, migration := range migrations {
+		known[migration.Version] = true
+	}
+	for version := range applied {
+		if !known[version] {
+			return nil, fmt.Errorf("migration %d is applied but unknown to this build, revert it with the build that has it", version)
+		}
+	}
+	ran := []Migration{}
+	for i := len(migrations) - 1; i >= 0 && len(ran) < steps; i-- {
+		migration := migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if err := runMigration(ctx, conn, migration, false); err != nil {
+			return ran, err
+		}
+		log.Printf("reverted migration %04d_%s", migration.Version, migration.Name)
+		ran = append(ran, migration)
+	}
+	return ran, nil
+}
+
+/*
+apply every pending postgres migration to db, returns the ones applied
+*/
+func MigrateUp(db *sql.DB) ([]Migration, error) {
+	var ran []Migration
+	err := withMigrationLock(db, postgresMigrations, func(ctx context.Context, conn *sql.Conn, migrations []Migration) (err error) {
+		ran, err = migrateUp(ctx, conn, migrations)
+		return err
+	})
+	return ran, err
+}
+
+/*
+revert the last steps applied migrations, returns the ones reverted
+*/
+func MigrateDown(db *sql.DB, steps int) ([]Migration, error) {
+	var ran []Migration
+	err := withMigrationLock(db, postgresMigrations, func(ctx context.Context, conn *sql.Conn, migrations []Migration) (err error) {
+		ran, err = migrateDown(ctx, conn, migrations, steps)
+		return err
+	})
+	return ran, err
+}
+
+/*
+revert the last applied migration and apply it again, returns it (nil when nothing was applied)
+*/
+func MigrateRedo(db *sql.DB) (*Migration, error) {
+	var redone *Migration
+	err := withMigrationLock(db, postgresMigrations, func(ctx context.Context, conn *sql.Conn, migrations []Migration) error {
+		reverted, err := migrateDown(ctx, conn, migrations, 1)
+		if err != nil || len(reverted) == 0 {
+			return err
+		}
+		redone = &reverted[0]
+		return runMigration(ctx, conn, *redone, true)
+	})
+	if redone != nil && err == nil {
+		log.Printf("applied migration %04d_%s", redone.Version, redone.Name)
+	}
+	return redone, err
+}
+
+/*
+list every migration and whether it has been applied
+*/
+func FetchMigrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := withMigrationLock(db, postgresMigrations, func(ctx context.Context, conn *sql.Conn, migrations []Migration) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range migrations {
+			status := MigrationStatus{Migration: migration}
+			if appliedAt, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
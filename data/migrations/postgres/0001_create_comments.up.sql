@@ -0,0 +1,9 @@
+-- IF NOT EXISTS throughout, databases set up before versioned migrations already have most of this schema
+CREATE TABLE IF NOT EXISTS comments (
+	id SERIAL PRIMARY KEY,
+	movie_id VARCHAR(255) NOT NULL,
+	body VARCHAR(500) NOT NULL,
+	user_public_ip VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
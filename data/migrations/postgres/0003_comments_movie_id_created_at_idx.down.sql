@@ -0,0 +1 @@
+DROP INDEX IF EXISTS comments_movie_id_created_at_idx;
@@ -0,0 +1,2 @@
+-- comments are listed per movie newest first, see SQLCommentRepository.FetchPage
+CREATE INDEX IF NOT EXISTS comments_movie_id_created_at_idx ON comments (movie_id, created_at DESC, id DESC);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS comments_parent_id_idx;
+ALTER TABLE comments DROP COLUMN IF EXISTS depth, DROP COLUMN IF EXISTS parent_id;
@@ -0,0 +1,4 @@
+ALTER TABLE comments
+	ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES comments (id),
+	ADD COLUMN IF NOT EXISTS depth INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS comments_parent_id_idx ON comments (parent_id);
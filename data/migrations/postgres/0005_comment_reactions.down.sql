@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS comment_reactions;
+ALTER TABLE comments DROP COLUMN IF EXISTS reactions, DROP COLUMN IF EXISTS score;
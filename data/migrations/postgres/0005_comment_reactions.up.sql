@@ -0,0 +1,11 @@
+ALTER TABLE comments
+	ADD COLUMN IF NOT EXISTS score INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS reactions JSONB NOT NULL DEFAULT '{}';
+CREATE TABLE IF NOT EXISTS comment_reactions (
+	id SERIAL PRIMARY KEY,
+	comment_id INTEGER NOT NULL REFERENCES comments (id) ON DELETE CASCADE,
+	voter VARCHAR(255) NOT NULL,
+	reaction VARCHAR(32) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (comment_id, voter, reaction)
+);
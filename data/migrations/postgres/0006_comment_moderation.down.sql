@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS comment_flags;
+DROP INDEX IF EXISTS comments_status_created_at_idx;
+ALTER TABLE comments DROP COLUMN IF EXISTS status;
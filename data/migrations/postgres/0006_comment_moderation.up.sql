@@ -0,0 +1,11 @@
+-- comments from before moderation are taken as approved
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'approved';
+CREATE INDEX IF NOT EXISTS comments_status_created_at_idx ON comments (status, created_at);
+CREATE TABLE IF NOT EXISTS comment_flags (
+	id SERIAL PRIMARY KEY,
+	comment_id INTEGER NOT NULL REFERENCES comments (id) ON DELETE CASCADE,
+	flagger VARCHAR(255) NOT NULL,
+	reason VARCHAR(255) NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (comment_id, flagger)
+);
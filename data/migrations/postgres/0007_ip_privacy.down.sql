@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS comments_ip_format_created_at_idx;
+ALTER TABLE comments DROP COLUMN IF EXISTS author_handle, DROP COLUMN IF EXISTS ip_format;
@@ -0,0 +1,5 @@
+-- addresses stored before ip privacy are raw, their authors get a handle from the retention job
+ALTER TABLE comments
+	ADD COLUMN IF NOT EXISTS ip_format VARCHAR(16) NOT NULL DEFAULT 'raw',
+	ADD COLUMN IF NOT EXISTS author_handle VARCHAR(32) NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS comments_ip_format_created_at_idx ON comments (ip_format, created_at);
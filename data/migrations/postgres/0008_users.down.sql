@@ -0,0 +1,2 @@
+ALTER TABLE comments DROP COLUMN IF EXISTS user_id;
+DROP TABLE IF EXISTS users;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(100) NOT NULL,
+	prefix VARCHAR(16) NOT NULL,
+	key_hash VARCHAR(64) NOT NULL UNIQUE,
+	scopes TEXT[] NOT NULL DEFAULT '{}',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP
+);
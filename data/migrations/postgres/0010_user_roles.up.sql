@@ -0,0 +1,2 @@
+-- accounts from before roles are commenters
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'commenter';
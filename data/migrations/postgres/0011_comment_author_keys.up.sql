@@ -0,0 +1,2 @@
+-- keyed hash of the author's address, anonymous authors are recognised by it once their address is truncated
+ALTER TABLE comments ADD COLUMN IF NOT EXISTS author_key VARCHAR(64) NOT NULL DEFAULT '';
@@ -0,0 +1 @@
+ALTER TABLE comments ALTER COLUMN author_handle TYPE VARCHAR(32) USING LEFT(author_handle, 32);
@@ -0,0 +1,2 @@
+-- signed in authors go by their username, which can be up to 50 characters
+ALTER TABLE comments ALTER COLUMN author_handle TYPE VARCHAR(50);
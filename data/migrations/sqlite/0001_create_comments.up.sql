@@ -0,0 +1,8 @@
+CREATE TABLE comments (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	movie_id VARCHAR(255) NOT NULL,
+	body VARCHAR(500) NOT NULL,
+	user_public_ip VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+ALTER TABLE comments ADD COLUMN deleted_at TIMESTAMP;
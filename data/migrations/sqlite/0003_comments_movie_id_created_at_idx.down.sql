@@ -0,0 +1 @@
+DROP INDEX comments_movie_id_created_at_idx;
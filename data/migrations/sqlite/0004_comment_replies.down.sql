@@ -0,0 +1,3 @@
+DROP INDEX comments_parent_id_idx;
+ALTER TABLE comments DROP COLUMN depth;
+ALTER TABLE comments DROP COLUMN parent_id;
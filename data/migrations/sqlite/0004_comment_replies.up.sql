@@ -0,0 +1,4 @@
+-- sqlite can't drop a column that is part of a foreign key, so unlike postgres parent_id doesn't reference comments
+ALTER TABLE comments ADD COLUMN parent_id INTEGER;
+ALTER TABLE comments ADD COLUMN depth INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX comments_parent_id_idx ON comments (parent_id);
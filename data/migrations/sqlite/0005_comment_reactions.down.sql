@@ -0,0 +1,3 @@
+DROP TABLE comment_reactions;
+ALTER TABLE comments DROP COLUMN reactions;
+ALTER TABLE comments DROP COLUMN score;
@@ -0,0 +1,10 @@
+ALTER TABLE comments ADD COLUMN score INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE comments ADD COLUMN reactions TEXT NOT NULL DEFAULT '{}';
+CREATE TABLE comment_reactions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	comment_id INTEGER NOT NULL REFERENCES comments (id) ON DELETE CASCADE,
+	voter VARCHAR(255) NOT NULL,
+	reaction VARCHAR(32) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (comment_id, voter, reaction)
+);
@@ -0,0 +1,3 @@
+DROP TABLE comment_flags;
+DROP INDEX comments_status_created_at_idx;
+ALTER TABLE comments DROP COLUMN status;
@@ -0,0 +1,10 @@
+ALTER TABLE comments ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'approved';
+CREATE INDEX comments_status_created_at_idx ON comments (status, created_at);
+CREATE TABLE comment_flags (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	comment_id INTEGER NOT NULL REFERENCES comments (id) ON DELETE CASCADE,
+	flagger VARCHAR(255) NOT NULL,
+	reason VARCHAR(255) NOT NULL DEFAULT '',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (comment_id, flagger)
+);
@@ -0,0 +1,3 @@
+DROP INDEX comments_ip_format_created_at_idx;
+ALTER TABLE comments DROP COLUMN author_handle;
+ALTER TABLE comments DROP COLUMN ip_format;
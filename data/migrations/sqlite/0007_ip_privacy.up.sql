@@ -0,0 +1,3 @@
+ALTER TABLE comments ADD COLUMN ip_format VARCHAR(16) NOT NULL DEFAULT 'raw';
+ALTER TABLE comments ADD COLUMN author_handle VARCHAR(32) NOT NULL DEFAULT '';
+CREATE INDEX comments_ip_format_created_at_idx ON comments (ip_format, created_at);
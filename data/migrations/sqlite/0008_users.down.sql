@@ -0,0 +1,2 @@
+ALTER TABLE comments DROP COLUMN user_id;
+DROP TABLE users;
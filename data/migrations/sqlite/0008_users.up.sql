@@ -0,0 +1,10 @@
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username VARCHAR(50) NOT NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX users_username_idx ON users (LOWER(username));
+-- no reference to users, for the same reason as parent_id
+ALTER TABLE comments ADD COLUMN user_id INTEGER;
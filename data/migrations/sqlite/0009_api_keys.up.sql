@@ -0,0 +1,11 @@
+-- scopes are a json array rather than a postgres array
+CREATE TABLE api_keys (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(100) NOT NULL,
+	prefix VARCHAR(16) NOT NULL,
+	key_hash VARCHAR(64) NOT NULL UNIQUE,
+	scopes TEXT NOT NULL DEFAULT '[]',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP
+);
@@ -0,0 +1,9 @@
+-- one row per refresh token, a token is revoked once it has been exchanged for a new pair
+CREATE TABLE refresh_tokens (
+	id VARCHAR(64) PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP NOT NULL,
+	revoked_at TIMESTAMP
+);
+CREATE INDEX refresh_tokens_user_id_idx ON refresh_tokens (user_id);
@@ -0,0 +1,3 @@
+-- sqlite doesn't enforce the length of a VARCHAR, so author_handle already takes the 50 characters of a username.
+-- kept so both databases are at the same schema version
+SELECT 1;
@@ -2,27 +2,71 @@ package data
 
 import (
 	"context"
-	"log"
-	"sync"
+	"database/sql"
+	"fmt"
+	"strings"
 	"time"
-
-	"github.com/showbaba/movies-api/utils"
 )
 
 type Comment struct {
-	ID           int       `json:"id"`
-	MovieID      string    `json:"movie_id"`
-	Body         string    `json:"body"`
-	UserPublicIP string    `json:"user_public_ip"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID      int    `json:"id"`
+	MovieID string `json:"movie_id"`
+	// the comment this one replies to, nil for top level comments
+	ParentID *int `json:"parent_id"`
+	// how deep in its thread the comment is, top level comments are 0
+	Depth int    `json:"depth"`
+	Body  string `json:"body"`
+	// who wrote the comment, stored as described by IPFormat. it is never sent to clients, AuthorHandle stands in for it
+	UserPublicIP string `json:"-"`
+	// one of the IPFormat constants
+	IPFormat string `json:"-"`
+	// keyed hash of the author's address, it still recognises an anonymous author once UserPublicIP is truncated
+	AuthorKey string `json:"-"`
+	// the account that wrote the comment, nil for anonymous comments
+	UserID *int `json:"user_id"`
+	// stable pseudonym of the author, the same for every comment from the same address (or the username of UserID)
+	AuthorHandle string `json:"author"`
+	// one of the Status constants, only approved comments are public
+	Status string `json:"status"`
+	// upvotes minus downvotes
+	Score int `json:"score"`
+	// how many times each reaction was given, votes included
+	Reactions ReactionCounts `json:"reactions"`
+	CreatedAt time.Time      `json:"created_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+// columns selected for every comment, keep in step with scanComment
+const commentColumns = `id, movie_id, parent_id, depth, body, user_public_ip, ip_format, author_key, user_id, author_handle, status, score, reactions, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanComment reads a row selected with commentColumns, extra receives any columns selected after them
+func scanComment(row rowScanner, extra ...interface{}) (*Comment, error) {
+	var comment Comment
+	dest := []interface{}{&comment.ID, &comment.MovieID, &comment.ParentID, &comment.Depth, &comment.Body, &comment.UserPublicIP,
+		&comment.IPFormat, &comment.AuthorKey, &comment.UserID, &comment.AuthorHandle, &comment.Status, &comment.Score, &comment.Reactions, &comment.CreatedAt, &comment.UpdatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	return &comment, nil
 }
 
 /*
-fetch comment by movieID
+fetch the approved comments of movieID ordered by sortBy (one of the Sort constants, newest first when empty)
 */
-func (c *Comment) Fetch(movieID string) ([]*Comment, error) {
-	rows, err := db.Query(`SELECT id, movie_id, body, user_public_ip, created_at, updated_at FROM comments WHERE movie_id = $1`, movieID)
+func (r *SQLCommentRepository) Fetch(ctx context.Context, movieID string, sortBy string) ([]*Comment, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	keyExpr, descending := r.dialect.sortKey(sortBy)
+	order := "ASC"
+	if descending {
+		order = "DESC"
+	}
+	rows, err := r.conn().QueryContext(ctx, fmt.Sprintf(`SELECT %s FROM comments WHERE movie_id = $1 AND deleted_at IS NULL AND status = $2
+		ORDER BY %s %s, id %s`, commentColumns, keyExpr, order, order), movieID, StatusApproved)
 	if err != nil {
 		return nil, err
 	}
@@ -30,12 +74,11 @@ func (c *Comment) Fetch(movieID string) ([]*Comment, error) {
 	var comments []*Comment
 
 	for rows.Next() {
-		var comment Comment
-		err := rows.Scan(&comment.ID, &comment.MovieID, &comment.Body, &comment.UserPublicIP, &comment.CreatedAt, &comment.UpdatedAt)
+		comment, err := scanComment(rows)
 		if err != nil {
 			return nil, err
 		}
-		comments = append(comments, &comment)
+		comments = append(comments, comment)
 	}
 
 	if err = rows.Err(); err != nil {
@@ -45,74 +88,203 @@ func (c *Comment) Fetch(movieID string) ([]*Comment, error) {
 	return comments, nil
 }
 
+// CommentSummary is the comment count of a movie along with its most recent comments and its highest scoring one
+type CommentSummary struct {
+	Count  int
+	Latest []*Comment
+	// nil unless some comment has a positive score
+	Top *Comment
+}
+
+/*
+fetch the approved comment count and up to latest of the newest comments of every movie in movieIDs with a single query,
+movies without comments get an empty summary
+*/
+func (r *SQLCommentRepository) FetchSummaries(ctx context.Context, movieIDs []string, latest int) (map[string]*CommentSummary, error) {
+	summaries := make(map[string]*CommentSummary, len(movieIDs))
+	for _, movieID := range movieIDs {
+		summaries[movieID] = &CommentSummary{Latest: []*Comment{}}
+	}
+	if len(movieIDs) == 0 {
+		return summaries, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	args := []interface{}{latest, StatusApproved}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	query := `SELECT ` + commentColumns + `, total, position, score_position FROM (
+			SELECT ` + commentColumns + `,
+				ROW_NUMBER() OVER (PARTITION BY movie_id ORDER BY created_at DESC, id DESC) AS position,
+				ROW_NUMBER() OVER (PARTITION BY movie_id ORDER BY score DESC, created_at DESC, id DESC) AS score_position,
+				COUNT(*) OVER (PARTITION BY movie_id) AS total
+			FROM comments WHERE ` + r.dialect.oneOf("movie_id", movieIDs, arg) + ` AND deleted_at IS NULL AND status = $2
+		) ranked
+		WHERE position <= $1 OR score_position = 1 ORDER BY movie_id, position`
+	rows, err := r.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var total, position, scorePosition int
+		comment, err := scanComment(rows, &total, &position, &scorePosition)
+		if err != nil {
+			return nil, err
+		}
+		summary := summaries[comment.MovieID]
+		summary.Count = total
+		if position <= latest {
+			summary.Latest = append(summary.Latest, comment)
+		}
+		if scorePosition == 1 && comment.Score > 0 {
+			summary.Top = comment
+		}
+	}
+	return summaries, rows.Err()
+}
+
 /*
 create a new comment
 */
-func (c *Comment) Insert() (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (r *SQLCommentRepository) Insert(ctx context.Context, c *Comment) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
-	var id int
-	query := `INSERT INTO comments (movie_id, body, user_public_ip, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5) RETURNING id`
-	if err := db.QueryRowContext(ctx, query,
-		&c.MovieID, &c.Body,
-		&c.UserPublicIP,
-		time.Now(), time.Now()).Scan(&id); err != nil {
+	if c.Status == "" {
+		c.Status = StatusApproved
+	}
+	if c.IPFormat == "" {
+		c.IPFormat = IPFormatRaw
+	}
+	query := `INSERT INTO comments (movie_id, parent_id, depth, body, user_public_ip, ip_format, author_key, user_id, author_handle, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id`
+	now := r.now()
+	if err := r.conn().QueryRowContext(ctx, query,
+		c.MovieID, c.ParentID, c.Depth, c.Body,
+		c.UserPublicIP, c.IPFormat, c.AuthorKey, c.UserID, c.AuthorHandle, c.Status,
+		now, now).Scan(&c.ID); err != nil {
 		return 0, err
 	}
-	return id, nil
+	c.CreatedAt, c.UpdatedAt = now, now
+	return c.ID, nil
 }
 
 /*
-this is a custom function that runs db migrations
-(on a second thought, i think with some modifications this can be made into a mini package for db migration)
+fetch a single comment by id whatever its status, returns nil if it does not exist or has been deleted
 */
-func Migrate() {
-	const TOTAL_WORKERS = 1
-	var (
-		wg      sync.WaitGroup
-		errorCh = make(chan error, TOTAL_WORKERS)
-	)
-	wg.Add(TOTAL_WORKERS)
-	log.Println("running db migration :::::::::::::")
-
-	go func() {
-		defer wg.Done()
-		ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
-		defer cancel()
-		// check if table exist before creating
-		tableExist, err := utils.CheckTableExist(ctx, db, "comments")
-		if err != nil {
-			errorCh <- err
-		}
-		if !tableExist {
-			query := `CREATE TABLE comments (
-			id SERIAL PRIMARY KEY,
-			movie_id VARCHAR(255) NOT NULL,
-			body VARCHAR(500) NOT NULL,
-			user_public_ip VARCHAR(255) NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-			);`
-			_, err := db.ExecContext(ctx, query)
-			if err != nil {
-				errorCh <- err
-			}
+func (r *SQLCommentRepository) GetByID(ctx context.Context, id int) (*Comment, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	query := `SELECT ` + commentColumns + ` FROM comments WHERE id = $1 AND deleted_at IS NULL`
+	comment, err := scanComment(r.conn().QueryRowContext(ctx, query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
-	}()
+		return nil, err
+	}
+	return comment, nil
+}
 
-	// more go routines can be added here and number of TOTAL_WORKERS increased to handle other tables
+/*
+save the body and status of the comment, updated_at is set to the time of the edit.
+returns ErrCommentNotFound when the comment has been deleted
+*/
+func (r *SQLCommentRepository) Update(ctx context.Context, c *Comment) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	query := `UPDATE comments SET body = $1, status = $2, updated_at = $3 WHERE id = $4 AND deleted_at IS NULL RETURNING updated_at`
+	err := r.conn().QueryRowContext(ctx, query, c.Body, c.Status, r.now(), c.ID).Scan(&c.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrCommentNotFound
+	}
+	return err
+}
 
-	go func() {
-		wg.Wait()
-		close(errorCh)
-	}()
+/*
+soft delete the comment, the row is kept but no longer returned by any fetch
+*/
+func (r *SQLCommentRepository) Delete(ctx context.Context, c *Comment) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	query := `UPDATE comments SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`
+	result, err := r.conn().ExecContext(ctx, query, r.now(), c.ID)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrCommentNotFound
+	}
+	return nil
+}
 
-	for err := range errorCh {
-		if err != nil {
-			panic(err)
+// checkVisible returns ErrCommentNotFound unless the comment exists and has not been deleted
+func (r *SQLCommentRepository) checkVisible(ctx context.Context, id int) error {
+	var found int
+	err := r.conn().QueryRowContext(ctx, `SELECT 1 FROM comments WHERE id = $1 AND deleted_at IS NULL`, id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return ErrCommentNotFound
+	}
+	return err
+}
+
+/*
+fetch the distinct movie ids comments are attached to
+*/
+func (r *SQLCommentRepository) MovieIDs(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	rows, err := r.conn().QueryContext(ctx, `SELECT DISTINCT movie_id FROM comments`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var movieIDs []string
+	for rows.Next() {
+		var movieID string
+		if err := rows.Scan(&movieID); err != nil {
+			return nil, err
 		}
+		movieIDs = append(movieIDs, movieID)
 	}
+	return movieIDs, rows.Err()
+}
 
-	log.Println("complete db migration")
+/*
+move comments from one movie id to another, mapping is old id -> new id.
+it runs as a single statement so chains such as 1 -> 2 and 2 -> 1 are applied at once instead of one after the other
+*/
+func (r *SQLCommentRepository) RemapMovieIDs(ctx context.Context, mapping map[string]string) (int64, error) {
+	var (
+		cases  []string
+		oldIDs []string
+		args   []interface{}
+	)
+	for oldID, newID := range mapping {
+		if oldID == newID {
+			continue
+		}
+		cases = append(cases, fmt.Sprintf("WHEN $%d THEN $%d", len(args)+1, len(args)+2))
+		oldIDs = append(oldIDs, fmt.Sprintf("$%d", len(args)+1))
+		args = append(args, oldID, newID)
+	}
+	if len(args) == 0 {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	query := `UPDATE comments SET movie_id = CASE movie_id ` + strings.Join(cases, " ") + ` END
+		WHERE movie_id IN (` + strings.Join(oldIDs, ", ") + `)`
+	result, err := r.conn().ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
 }
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+)
+
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+	// approved comments that enough users flagged, hidden until a moderator reviews them
+	StatusFlagged = "flagged"
+)
+
+/*
+record a flag from flagger against the comment, each flagger counts once.
+once threshold flaggers have flagged an approved comment it is moved to flagged, which takes it out of public listings.
+returns ErrCommentNotFound when the comment has been deleted
+*/
+func (r *SQLCommentRepository) Flag(ctx context.Context, c *Comment, flagger, reason string, threshold int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	return r.withTx(ctx, func(repo *SQLCommentRepository) error {
+		if err := repo.checkVisible(ctx, c.ID); err != nil {
+			return err
+		}
+		if _, err := repo.tx.ExecContext(ctx, `INSERT INTO comment_flags (comment_id, flagger, reason) VALUES ($1, $2, $3)
+			ON CONFLICT (comment_id, flagger) DO NOTHING`, c.ID, flagger, reason); err != nil {
+			return err
+		}
+		query := `UPDATE comments SET status = $2
+			WHERE id = $1 AND status = $3 AND (SELECT COUNT(*) FROM comment_flags WHERE comment_id = $1) >= $4
+			RETURNING status`
+		err := repo.tx.QueryRowContext(ctx, query, c.ID, StatusFlagged, StatusApproved, threshold).Scan(&c.Status)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return nil
+	})
+}
+
+/*
+set the status of the comment as a moderator. approving clears its flags, since a moderator has looked at them
+*/
+func (r *SQLCommentRepository) Moderate(ctx context.Context, c *Comment, status string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	err := r.withTx(ctx, func(repo *SQLCommentRepository) error {
+		if _, err := repo.tx.ExecContext(ctx, `UPDATE comments SET status = $1 WHERE id = $2 AND deleted_at IS NULL`, status, c.ID); err != nil {
+			return err
+		}
+		if status == StatusApproved {
+			if _, err := repo.tx.ExecContext(ctx, `DELETE FROM comment_flags WHERE comment_id = $1`, c.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.Status = status
+	return nil
+}
@@ -0,0 +1,201 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	SortNewest = "newest"
+	SortOldest = "oldest"
+	// highest score first
+	SortScore = "score"
+	// score weighted by age, a fresh comment with a few votes beats an old one with slightly more
+	SortHot = "hot"
+)
+
+// hotRank is the key of SortHot, every 12.5 hours of age is worth a tenfold score as in reddit's hot ranking.
+// the sql dialects compute the same in their queries
+func hotRank(score int, createdAt time.Time) float64 {
+	sign := 0.0
+	if score > 0 {
+		sign = 1
+	} else if score < 0 {
+		sign = -1
+	}
+	return sign*math.Log10(math.Max(math.Abs(float64(score)), 1)) + float64(createdAt.UnixNano())/1e9/45000
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in a list of comments, the sort key and id of the comment it points at.
+// the sort key is CreatedAt when sorting by date and Key when sorting by score
+type Cursor struct {
+	Sort      string    `json:"s,omitempty"`
+	CreatedAt time.Time `json:"t"`
+	Key       float64   `json:"k,omitempty"`
+	ID        int       `json:"i"`
+}
+
+// Encode turns the cursor into the opaque string handed to clients
+func (c Cursor) Encode() string {
+	content, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func DecodeCursor(value string) (*Cursor, error) {
+	content, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor Cursor
+	if err := json.Unmarshal(content, &cursor); err != nil || cursor.ID == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// CommentPageQuery selects a page of comments. at most one of After and Before is set,
+// After pages forward (towards older comments when sorting newest first) and Before pages back
+type CommentPageQuery struct {
+	// the movie to list comments of, every movie when empty
+	MovieID string
+	// the statuses to list, only approved comments when empty
+	Statuses []string
+	Sort     string
+	Limit    int
+	After    *Cursor
+	Before   *Cursor
+	// only list top level comments, leaving replies out
+	RootsOnly bool
+}
+
+type CommentPage struct {
+	Comments   []*Comment `json:"comments"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+	PrevCursor string     `json:"prev_cursor,omitempty"`
+}
+
+/*
+fetch a page of comments using keyset pagination on (sort key, id), so pages stay stable while comments are added
+*/
+func (r *SQLCommentRepository) FetchPage(ctx context.Context, query CommentPageQuery) (*CommentPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	if query.Sort == "" {
+		query.Sort = SortNewest
+	}
+	keyExpr, descending := r.dialect.sortKey(query.Sort)
+	byDate := keyExpr == "created_at"
+	// paging back walks the list in the opposite direction and flips the rows afterwards
+	backwards := query.Before != nil
+	cursor := query.After
+	if backwards {
+		cursor = query.Before
+	}
+	// a cursor only makes sense for the sort it was handed out with
+	if cursor != nil && cursor.Sort != "" && cursor.Sort != query.Sort {
+		return nil, ErrInvalidCursor
+	}
+
+	comparison, order := "<", "DESC"
+	if descending == backwards {
+		comparison, order = ">", "ASC"
+	}
+
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	statuses := query.Statuses
+	if len(statuses) == 0 {
+		statuses = []string{StatusApproved}
+	}
+	where := `deleted_at IS NULL AND ` + r.dialect.oneOf("status", statuses, arg)
+	if query.MovieID != "" {
+		where += ` AND movie_id = ` + arg(query.MovieID)
+	}
+	if query.RootsOnly {
+		where += ` AND parent_id IS NULL`
+	}
+	if cursor != nil {
+		key := interface{}(cursor.Key)
+		if byDate {
+			key = r.timeArg(cursor.CreatedAt)
+		}
+		where += fmt.Sprintf(` AND (%s, id) %s (%s, %s)`, keyExpr, comparison, arg(key), arg(cursor.ID))
+	}
+	// one extra row tells whether there is anything past this page
+	sqlQuery := fmt.Sprintf(`SELECT %s, %s AS sort_key FROM comments
+		WHERE %s ORDER BY sort_key %s, id %s LIMIT %s`, commentColumns, keyExpr, where, order, order, arg(query.Limit+1))
+
+	rows, err := r.conn().QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	comments := make([]*Comment, 0, query.Limit+1)
+	keys := make([]float64, 0, query.Limit+1)
+	for rows.Next() {
+		var (
+			comment *Comment
+			err     error
+			key     float64
+		)
+		if byDate {
+			var createdAt time.Time
+			comment, err = scanComment(rows, &createdAt)
+		} else {
+			comment, err = scanComment(rows, &key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return newCommentPage(query, comments, keys), nil
+}
+
+// newCommentPage turns the rows fetched for query into its page. the rows are in the order they were walked in, which is
+// backwards when paging back, with one past the limit when there is more to walk. keys are their sort keys unless sorting by date
+func newCommentPage(query CommentPageQuery, comments []*Comment, keys []float64) *CommentPage {
+	backwards := query.Before != nil
+	hasMore := len(comments) > query.Limit
+	if hasMore {
+		comments = comments[:query.Limit]
+		keys = keys[:query.Limit]
+	}
+	if backwards {
+		for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
+			comments[i], comments[j] = comments[j], comments[i]
+			keys[i], keys[j] = keys[j], keys[i]
+		}
+	}
+
+	page := &CommentPage{Comments: comments}
+	if len(comments) == 0 {
+		return page
+	}
+	cursorAt := func(i int) string {
+		return Cursor{Sort: query.Sort, CreatedAt: comments[i].CreatedAt, Key: keys[i], ID: comments[i].ID}.Encode()
+	}
+	// going forward there is a previous page whenever we started from a cursor, going back there is always a next page
+	if hasMore || backwards {
+		page.NextCursor = cursorAt(len(comments) - 1)
+	}
+	if (backwards && hasMore) || (!backwards && query.After != nil) {
+		page.PrevCursor = cursorAt(0)
+	}
+	return page
+}
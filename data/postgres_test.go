@@ -0,0 +1,27 @@
+package data_test
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	"github.com/showbaba/movies-api/data"
+	"github.com/showbaba/movies-api/data/storetest"
+)
+
+// TestPostgresCommentRepository writes to the database of POSTGRES_TEST_DSN, which has to have no comments
+func TestPostgresCommentRepository(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := data.MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	storetest.CheckCommentRepository(t, data.NewPostgresCommentRepository(db))
+}
@@ -0,0 +1,153 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// how comments.user_public_ip is stored
+const (
+	IPFormatRaw = "raw"
+	// keyed hash of the address, it still tells authors apart but can't be turned back into the address
+	IPFormatHMAC = "hmac"
+	// the address with its host part zeroed (/24 for IPv4, /48 for IPv6)
+	IPFormatTruncated = "truncated"
+)
+
+// the voters of reactions and flaggers of flags are one of these identities
+const (
+	IdentityUserPrefix   = "user:"
+	IdentityAPIKeyPrefix = "apikey:"
+	// followed by a keyed hash of the address of an anonymous client, the address itself is never kept
+	IdentityAnonymousPrefix = "anon:"
+)
+
+// how many rows the retention job rewrites per statement
+const privacyBatchSize = 500
+
+/*
+give every comment without an author handle one, handle works it out from the stored address. returns how many comments were updated
+*/
+func (r *SQLCommentRepository) FillAuthorHandles(ctx context.Context, handle func(storedIP string) string) (int, error) {
+	return r.rewriteRows(ctx, `SELECT id, user_public_ip FROM comments WHERE author_handle = '' ORDER BY id LIMIT $1`,
+		func(ctx context.Context, repo *SQLCommentRepository, id int, ip string) error {
+			_, err := repo.tx.ExecContext(ctx, `UPDATE comments SET author_handle = $2 WHERE id = $1`, id, handle(ip))
+			return err
+		})
+}
+
+/*
+replace the raw addresses of comments created before cutoff with what protect makes of them, protect returns the new value and its IPFormat.
+returns how many comments were updated
+*/
+func (r *SQLCommentRepository) PurgeRawIPs(ctx context.Context, cutoff time.Time, protect func(ip string) (string, string)) (int, error) {
+	return r.rewriteRows(ctx, `SELECT id, user_public_ip FROM comments
+			WHERE ip_format = '`+IPFormatRaw+`' AND created_at < $2 ORDER BY id LIMIT $1`,
+		func(ctx context.Context, repo *SQLCommentRepository, id int, ip string) error {
+			value, newFormat := protect(ip)
+			_, err := repo.tx.ExecContext(ctx, `UPDATE comments SET user_public_ip = $2, ip_format = $3 WHERE id = $1`, id, value, newFormat)
+			return err
+		}, r.timeArg(cutoff))
+}
+
+/*
+replace the voters and flaggers still stored as an address (every one that isn't an account, an api key or already hashed)
+with IdentityAnonymousPrefix followed by what hash makes of the address. a row whose client already has the same row under
+the hashed identity is dropped instead. returns how many rows were rewritten or dropped
+*/
+func (r *SQLCommentRepository) HashAnonymousIdentities(ctx context.Context, hash func(stored string) string) (int, error) {
+	reactions, err := r.rewriteRows(ctx, `SELECT id, voter FROM comment_reactions WHERE `+storedAddress("voter")+` ORDER BY id LIMIT $1`,
+		func(ctx context.Context, repo *SQLCommentRepository, id int, voter string) error {
+			return repo.rehashIdentity(ctx, "comment_reactions", "voter", "AND other.reaction = comment_reactions.reaction", id, IdentityAnonymousPrefix+hash(voter))
+		})
+	if err != nil {
+		return reactions, err
+	}
+	flags, err := r.rewriteRows(ctx, `SELECT id, flagger FROM comment_flags WHERE `+storedAddress("flagger")+` ORDER BY id LIMIT $1`,
+		func(ctx context.Context, repo *SQLCommentRepository, id int, flagger string) error {
+			return repo.rehashIdentity(ctx, "comment_flags", "flagger", "", id, IdentityAnonymousPrefix+hash(flagger))
+		})
+	return reactions + flags, err
+}
+
+// storedAddress is the condition that column holds an address rather than one of the identities
+func storedAddress(column string) string {
+	return column + ` NOT LIKE '` + IdentityUserPrefix + `%' AND ` + column + ` NOT LIKE '` + IdentityAPIKeyPrefix + `%' AND ` +
+		column + ` NOT LIKE '` + IdentityAnonymousPrefix + `%'`
+}
+
+// rehashIdentity moves the row id of table over to identity, the rows a client can have more than one of on a comment
+// are told apart by sameAs. the reactions of the comment are refreshed when a duplicate is dropped
+func (r *SQLCommentRepository) rehashIdentity(ctx context.Context, table, column, sameAs string, id int, identity string) error {
+	result, err := r.tx.ExecContext(ctx, `UPDATE `+table+` SET `+column+` = $2 WHERE id = $1 AND NOT EXISTS (
+			SELECT 1 FROM `+table+` other WHERE other.comment_id = `+table+`.comment_id AND other.`+column+` = $2 `+sameAs+`
+		)`, id, identity)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated > 0 {
+		return err
+	}
+	var commentID int
+	if err := r.tx.QueryRowContext(ctx, `DELETE FROM `+table+` WHERE id = $1 RETURNING comment_id`, id).Scan(&commentID); err != nil {
+		return err
+	}
+	if table == "comment_reactions" {
+		return r.refreshReactions(ctx, &Comment{ID: commentID})
+	}
+	return nil
+}
+
+// rewriteRows rewrites the rows picked by selectQuery (which takes the batch size as $1, then args, and selects an id and a value)
+// a batch at a time, each row is rewritten by rewrite within the transaction of its batch. it stops once a batch comes back short
+func (r *SQLCommentRepository) rewriteRows(ctx context.Context, selectQuery string, rewrite func(ctx context.Context, repo *SQLCommentRepository, id int, value string) error, args ...interface{}) (int, error) {
+	updated := 0
+	for {
+		count, err := r.rewriteBatch(ctx, selectQuery, rewrite, args)
+		updated += count
+		if err != nil || count < privacyBatchSize {
+			return updated, err
+		}
+	}
+}
+
+func (r *SQLCommentRepository) rewriteBatch(ctx context.Context, selectQuery string, rewrite func(ctx context.Context, repo *SQLCommentRepository, id int, value string) error, args []interface{}) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	count := 0
+	err := r.withTx(ctx, func(repo *SQLCommentRepository) error {
+		rows, err := repo.tx.QueryContext(ctx, selectQuery, append([]interface{}{privacyBatchSize}, args...)...)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id    int
+			value string
+		}
+		var batch []row
+		for rows.Next() {
+			var selected row
+			if err := rows.Scan(&selected.id, &selected.value); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, selected)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, selected := range batch {
+			if err := rewrite(ctx, repo, selected.id, selected.value); err != nil {
+				return err
+			}
+		}
+		count = len(batch)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,108 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	ReactionUpvote   = "upvote"
+	ReactionDownvote = "downvote"
+)
+
+// ReactionCounts maps a reaction to how many times it was given, it is stored as jsonb on the comment
+type ReactionCounts map[string]int
+
+func (r *ReactionCounts) Scan(value interface{}) error {
+	var content []byte
+	switch v := value.(type) {
+	case nil:
+		*r = ReactionCounts{}
+		return nil
+	case []byte:
+		content = v
+	case string:
+		content = []byte(v)
+	default:
+		return fmt.Errorf("can't scan %T into ReactionCounts", value)
+	}
+	counts := ReactionCounts{}
+	if err := json.Unmarshal(content, &counts); err != nil {
+		return err
+	}
+	*r = counts
+	return nil
+}
+
+func (r ReactionCounts) Value() (driver.Value, error) {
+	if r == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(r)
+}
+
+/*
+add a reaction from voter to the comment, giving the same reaction twice is a no-op.
+upvotes and downvotes cancel each other out, a voter only ever has one of them on a comment.
+the comment's score and reaction counts are refreshed in the same transaction.
+returns ErrCommentNotFound when the comment has been deleted
+*/
+func (r *SQLCommentRepository) AddReaction(ctx context.Context, c *Comment, voter, reaction string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	return r.withTx(ctx, func(repo *SQLCommentRepository) error {
+		if err := repo.checkVisible(ctx, c.ID); err != nil {
+			return err
+		}
+		if opposite := oppositeVote(reaction); opposite != "" {
+			if _, err := repo.tx.ExecContext(ctx, `DELETE FROM comment_reactions WHERE comment_id = $1 AND voter = $2 AND reaction = $3`,
+				c.ID, voter, opposite); err != nil {
+				return err
+			}
+		}
+		if _, err := repo.tx.ExecContext(ctx, `INSERT INTO comment_reactions (comment_id, voter, reaction) VALUES ($1, $2, $3)
+			ON CONFLICT (comment_id, voter, reaction) DO NOTHING`, c.ID, voter, reaction); err != nil {
+			return err
+		}
+		return repo.refreshReactions(ctx, c)
+	})
+}
+
+/*
+remove a reaction voter gave to the comment, removing one that was never given is a no-op
+*/
+func (r *SQLCommentRepository) RemoveReaction(ctx context.Context, c *Comment, voter, reaction string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	return r.withTx(ctx, func(repo *SQLCommentRepository) error {
+		if _, err := repo.tx.ExecContext(ctx, `DELETE FROM comment_reactions WHERE comment_id = $1 AND voter = $2 AND reaction = $3`,
+			c.ID, voter, reaction); err != nil {
+			return err
+		}
+		return repo.refreshReactions(ctx, c)
+	})
+}
+
+// refreshReactions recomputes the denormalised score and reaction counts of the comment from comment_reactions
+func (r *SQLCommentRepository) refreshReactions(ctx context.Context, c *Comment) error {
+	query := `UPDATE comments SET
+			score = (SELECT COUNT(*) FILTER (WHERE reaction = $2) - COUNT(*) FILTER (WHERE reaction = $3)
+				FROM comment_reactions WHERE comment_id = $1),
+			reactions = COALESCE((SELECT ` + r.dialect.jsonObjectAgg + `(reaction, total) FROM (
+				SELECT reaction, COUNT(*) AS total FROM comment_reactions WHERE comment_id = $1 GROUP BY reaction
+			) counts), '{}')
+		WHERE id = $1 RETURNING score, reactions`
+	return r.conn().QueryRowContext(ctx, query, c.ID, ReactionUpvote, ReactionDownvote).Scan(&c.Score, &c.Reactions)
+}
+
+func oppositeVote(reaction string) string {
+	switch reaction {
+	case ReactionUpvote:
+		return ReactionDownvote
+	case ReactionDownvote:
+		return ReactionUpvote
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// RefreshTokenRepository keeps track of the refresh tokens handed out, so they can be used once and revoked
+type RefreshTokenRepository struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+func NewRefreshTokenRepository(db *sql.DB) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: db, dialect: postgresDialect}
+}
+
+/*
+record a refresh token with the id id issued to the user with userID
+*/
+func (r *RefreshTokenRepository) Insert(ctx context.Context, id string, userID int, expiresAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	query := `INSERT INTO refresh_tokens (id, user_id, created_at, expires_at) VALUES ($1, $2, $3, $4)`
+	_, err := r.db.ExecContext(ctx, query, id, userID, r.dialect.timeArg(time.Now()), r.dialect.timeArg(expiresAt))
+	return err
+}
+
+/*
+revoke the refresh token with id as it is exchanged for a new one, reports false when it was already revoked or has expired.
+of several concurrent uses of a token only one gets true
+*/
+func (r *RefreshTokenRepository) Use(ctx context.Context, id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	now := r.dialect.timeArg(time.Now())
+	query := `UPDATE refresh_tokens SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL AND expires_at > $2`
+	result, err := r.db.ExecContext(ctx, query, id, now)
+	if err != nil {
+		return false, err
+	}
+	used, err := result.RowsAffected()
+	return used == 1, err
+}
+
+/*
+revoke the refresh token with id, revoking it again does nothing
+*/
+func (r *RefreshTokenRepository) Revoke(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	_, err := r.db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = $2 WHERE id = $1 AND revoked_at IS NULL`, id, r.dialect.timeArg(time.Now()))
+	return err
+}
+
+/*
+revoke every refresh token of the user with userID and drop the expired ones, returns how many were revoked
+*/
+func (r *RefreshTokenRepository) RevokeAll(ctx context.Context, userID int) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	now := r.dialect.timeArg(time.Now())
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM refresh_tokens WHERE user_id = $1 AND expires_at <= $2`, userID, now); err != nil {
+		return 0, err
+	}
+	result, err := r.db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`, userID, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,156 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var ErrCommentNotFound = errors.New("comment not found")
+
+// CommentRepository stores comments along with their reactions and flags. every call takes the context of whatever it is
+// done for, the repository adds its own query timeout on top
+type CommentRepository interface {
+	// the approved comments of movieID ordered by sortBy, one of the Sort constants
+	Fetch(ctx context.Context, movieID string, sortBy string) ([]*Comment, error)
+	FetchPage(ctx context.Context, query CommentPageQuery) (*CommentPage, error)
+	FetchThreads(ctx context.Context, query CommentPageQuery) (*ThreadPage, error)
+	FetchSummaries(ctx context.Context, movieIDs []string, latest int) (map[string]*CommentSummary, error)
+	// nil when there is no such comment
+	GetByID(ctx context.Context, id int) (*Comment, error)
+	Insert(ctx context.Context, comment *Comment) (int, error)
+	// ErrCommentNotFound when the comment has been deleted
+	Update(ctx context.Context, comment *Comment) error
+	// ErrCommentNotFound when the comment has already been deleted
+	Delete(ctx context.Context, comment *Comment) error
+	// ErrCommentNotFound when the comment has been deleted
+	AddReaction(ctx context.Context, comment *Comment, voter, reaction string) error
+	RemoveReaction(ctx context.Context, comment *Comment, voter, reaction string) error
+	// ErrCommentNotFound when the comment has been deleted
+	Flag(ctx context.Context, comment *Comment, flagger, reason string, threshold int) error
+	Moderate(ctx context.Context, comment *Comment, status string) error
+	MovieIDs(ctx context.Context) ([]string, error)
+	RemapMovieIDs(ctx context.Context, mapping map[string]string) (int64, error)
+	FillAuthorHandles(ctx context.Context, handle func(storedIP string) string) (int, error)
+	PurgeRawIPs(ctx context.Context, cutoff time.Time, protect func(ip string) (string, string)) (int, error)
+	HashAnonymousIdentities(ctx context.Context, hash func(stored string) string) (int, error)
+	// WithTx runs f as a unit of work, everything f does through repo is committed together when it returns nil and
+	// rolled back otherwise. calling WithTx on repo joins the unit of work rather than starting another
+	WithTx(ctx context.Context, f func(repo CommentRepository) error) error
+}
+
+// querier is what *sql.DB and *sql.Tx have in common
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// SQLCommentRepository is the CommentRepository of the comments table, in postgres or sqlite
+type SQLCommentRepository struct {
+	db      *sql.DB
+	dialect *sqlDialect
+	// set on the copies handed to WithTx callbacks
+	tx *sql.Tx
+}
+
+// sqlDialect is what SQLCommentRepository does differently on each database, every query sticks to what both understand otherwise
+type sqlDialect struct {
+	// comments ordered by this are in hot order, see SortHot
+	hotRank string
+	// oneOf is the condition that expr is one of values, arg binds a value and returns its placeholder
+	oneOf func(expr string, values interface{}, arg func(value interface{}) string) string
+	// the aggregate function turning (key, value) rows into a json object
+	jsonObjectAgg string
+	// times are stored and compared as text, so they all have to be in one time zone
+	utcTimes bool
+	// textArray is values as a column holding a list of strings, both as a query argument and as a scan destination
+	textArray func(values *[]string) interface{}
+	// uniqueViolation reports whether err is a write rejected by a unique index
+	uniqueViolation func(err error) bool
+}
+
+var postgresDialect = &sqlDialect{
+	// every 12.5 hours of age is worth a tenfold score, as in reddit's hot ranking
+	hotRank: `(SIGN(score)::float8 * LOG(GREATEST(ABS(score), 1)::float8) + EXTRACT(EPOCH FROM created_at)::float8 / 45000)`,
+	oneOf: func(expr string, values interface{}, arg func(value interface{}) string) string {
+		return expr + ` = ANY(` + arg(pq.Array(values)) + `)`
+	},
+	jsonObjectAgg: "jsonb_object_agg",
+	textArray: func(values *[]string) interface{} {
+		return (*pq.StringArray)(values)
+	},
+	uniqueViolation: func(err error) bool {
+		var pqErr *pq.Error
+		return errors.As(err, &pqErr) && pqErr.Code == "23505"
+	},
+}
+
+func NewPostgresCommentRepository(db *sql.DB) *SQLCommentRepository {
+	return &SQLCommentRepository{db: db, dialect: postgresDialect}
+}
+
+// timeArg is t as it is stored
+func (d *sqlDialect) timeArg(t time.Time) time.Time {
+	if d.utcTimes {
+		return t.UTC()
+	}
+	return t
+}
+
+// sortKey returns the expression comments are ordered by for sortBy (ties are broken by id) and whether the order is descending
+func (d *sqlDialect) sortKey(sortBy string) (expr string, descending bool) {
+	switch sortBy {
+	case SortOldest:
+		return "created_at", false
+	case SortScore:
+		return "CAST(score AS DOUBLE PRECISION)", true
+	case SortHot:
+		return d.hotRank, true
+	default:
+		return "created_at", true
+	}
+}
+
+// now is the time to store as the current time
+func (r *SQLCommentRepository) now() time.Time {
+	return r.timeArg(time.Now())
+}
+
+// timeArg is t as it is stored
+func (r *SQLCommentRepository) timeArg(t time.Time) time.Time {
+	return r.dialect.timeArg(t)
+}
+
+// conn is what queries run on, the transaction of the unit of work if there is one
+func (r *SQLCommentRepository) conn() querier {
+	if r.tx != nil {
+		return r.tx
+	}
+	return r.db
+}
+
+func (r *SQLCommentRepository) WithTx(ctx context.Context, f func(repo CommentRepository) error) error {
+	return r.withTx(ctx, func(repo *SQLCommentRepository) error {
+		return f(repo)
+	})
+}
+
+// withTx is WithTx for the writes of the repository itself that need more than one statement
+func (r *SQLCommentRepository) withTx(ctx context.Context, f func(repo *SQLCommentRepository) error) error {
+	if r.tx != nil {
+		return f(r)
+	}
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := f(&SQLCommentRepository{db: r.db, dialect: r.dialect, tx: tx}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
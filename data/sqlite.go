@@ -0,0 +1,102 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	// pure go, so the sqlite store builds without cgo
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var sqliteDialect = &sqlDialect{
+	// julianday rather than unixepoch, which only takes fractions of a second from sqlite 3.42
+	hotRank: `(sign(score) * log10(max(abs(score), 1)) + (julianday(created_at) - 2440587.5) * 86400.0 / 45000)`,
+	oneOf: func(expr string, values interface{}, arg func(value interface{}) string) string {
+		content, _ := json.Marshal(values)
+		return expr + ` IN (SELECT value FROM json_each(` + arg(string(content)) + `))`
+	},
+	jsonObjectAgg: "json_group_object",
+	utcTimes:      true,
+	textArray: func(values *[]string) interface{} {
+		return jsonTextArray{values: values}
+	},
+	uniqueViolation: func(err error) bool {
+		var sqliteErr *sqlite.Error
+		return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	},
+}
+
+/*
+open the sqlite database at path, creating it if needed and migrating it to the latest schema.
+an empty path opens a private in-memory database that is gone once it is closed
+*/
+func OpenSQLite(path string) (*sql.DB, error) {
+	// times are stored in a format sqlite's date functions read, which also sorts in time order as text
+	dsn := "file:" + url.PathEscape(path) + "?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_time_format=sqlite"
+	if path == "" {
+		dsn = "file::memory:?_pragma=foreign_keys(1)&_time_format=sqlite"
+	}
+	sqliteDB, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite writes one at a time anyway, and an in-memory database only lives as long as its connection
+	sqliteDB.SetMaxOpenConns(1)
+	if err := withMigrationLock(sqliteDB, sqliteMigrations, func(ctx context.Context, conn *sql.Conn, migrations []Migration) error {
+		_, err := migrateUp(ctx, conn, migrations)
+		return err
+	}); err != nil {
+		sqliteDB.Close()
+		return nil, err
+	}
+	return sqliteDB, nil
+}
+
+/*
+the comments of a sqlite database opened by OpenSQLite
+*/
+func NewSQLiteCommentRepository(db *sql.DB) *SQLCommentRepository {
+	return &SQLCommentRepository{db: db, dialect: sqliteDialect}
+}
+
+/*
+every repository of a sqlite database opened by OpenSQLite
+*/
+func NewSQLite(db *sql.DB) Models {
+	return Models{
+		Comments:      NewSQLiteCommentRepository(db),
+		Users:         &UserRepository{db: db, dialect: sqliteDialect},
+		APIKeys:       &APIKeyRepository{db: db, dialect: sqliteDialect},
+		RefreshTokens: &RefreshTokenRepository{db: db, dialect: sqliteDialect},
+	}
+}
+
+// jsonTextArray keeps a list of strings in a text column as a json array
+type jsonTextArray struct {
+	values *[]string
+}
+
+func (a jsonTextArray) Value() (driver.Value, error) {
+	values := *a.values
+	if values == nil {
+		values = []string{}
+	}
+	content, err := json.Marshal(values)
+	return string(content), err
+}
+
+func (a jsonTextArray) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(src), a.values)
+	case []byte:
+		return json.Unmarshal(src, a.values)
+	}
+	return fmt.Errorf("cannot scan %T into a list of strings", src)
+}
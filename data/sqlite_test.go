@@ -0,0 +1,17 @@
+package data_test
+
+import (
+	"testing"
+
+	"github.com/showbaba/movies-api/data"
+	"github.com/showbaba/movies-api/data/storetest"
+)
+
+func TestSQLiteCommentRepository(t *testing.T) {
+	db, err := data.OpenSQLite("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	storetest.CheckCommentRepository(t, data.NewSQLiteCommentRepository(db))
+}
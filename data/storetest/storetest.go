@@ -0,0 +1,368 @@
+// Package storetest is the conformance suite of comment stores, every data.CommentRepository has to pass it so the app
+// behaves the same whichever one it runs on
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/showbaba/movies-api/data"
+)
+
+var errRollback = errors.New("storetest: rollback")
+
+type suite struct {
+	t    *testing.T
+	ctx  context.Context
+	repo data.CommentRepository
+}
+
+/*
+run the conformance suite against repo as part of the test t. repo has to be empty since the suite writes to it
+*/
+func CheckCommentRepository(t *testing.T, repo data.CommentRepository) {
+	t.Helper()
+	s := &suite{t: t, ctx: context.Background(), repo: repo}
+	movieIDs, err := repo.MovieIDs(s.ctx)
+	if err != nil {
+		t.Fatalf("MovieIDs: %v", err)
+	}
+	if len(movieIDs) > 0 {
+		t.Fatalf("the repository has to be empty, it has comments on %d movies", len(movieIDs))
+	}
+	s.checkComments()
+}
+
+func (s *suite) errorf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Errorf(format, args...)
+}
+
+func (s *suite) fatalf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Fatalf(format, args...)
+}
+
+// must stops the suite on err, what is the call that returned it
+func (s *suite) must(err error, what string) {
+	s.t.Helper()
+	if err != nil {
+		s.fatalf("%s: %v", what, err)
+	}
+}
+
+func (s *suite) insert(movieID, body, status string, parent *data.Comment) *data.Comment {
+	s.t.Helper()
+	comment := &data.Comment{MovieID: movieID, Body: body, UserPublicIP: "192.0.2." + fmt.Sprint(len(body)), AuthorKey: "key-" + body, Status: status}
+	if parent != nil {
+		comment.ParentID = &parent.ID
+		comment.Depth = parent.Depth + 1
+	}
+	id, err := s.repo.Insert(s.ctx, comment)
+	s.must(err, "Insert")
+	comment.ID = id
+	return comment
+}
+
+func (s *suite) get(id int) *data.Comment {
+	s.t.Helper()
+	comment, err := s.repo.GetByID(s.ctx, id)
+	s.must(err, "GetByID")
+	if comment == nil {
+		s.fatalf("GetByID(%d) found nothing", id)
+	}
+	return comment
+}
+
+// expectIDs checks that comments are the ones of want, in that order
+func (s *suite) expectIDs(what string, comments []*data.Comment, want ...*data.Comment) {
+	s.t.Helper()
+	got := make([]int, len(comments))
+	for i, comment := range comments {
+		got[i] = comment.ID
+	}
+	wantIDs := make([]int, len(want))
+	for i, comment := range want {
+		wantIDs[i] = comment.ID
+	}
+	if fmt.Sprint(got) != fmt.Sprint(wantIDs) {
+		s.errorf("%s: got comments %v, want %v", what, got, wantIDs)
+	}
+}
+
+func (s *suite) page(query data.CommentPageQuery) *data.CommentPage {
+	s.t.Helper()
+	page, err := s.repo.FetchPage(s.ctx, query)
+	s.must(err, "FetchPage")
+	return page
+}
+
+func (s *suite) cursor(value string) *data.Cursor {
+	s.t.Helper()
+	cursor, err := data.DecodeCursor(value)
+	s.must(err, "DecodeCursor")
+	return cursor
+}
+
+func (s *suite) checkComments() {
+	// inserting and fetching
+	a := s.insert("m1", "first", "", nil)
+	if a.ID == 0 || a.Status != data.StatusApproved || a.IPFormat != data.IPFormatRaw {
+		s.errorf("Insert: got id %d, status %q and ip format %q, want an id, %q and %q", a.ID, a.Status, a.IPFormat, data.StatusApproved, data.IPFormatRaw)
+	}
+	if got := s.get(a.ID); got.Body != "first" || got.MovieID != "m1" || got.AuthorKey != "key-first" || got.Score != 0 || got.Reactions == nil || len(got.Reactions) != 0 {
+		s.errorf("GetByID: got %+v, want the comment as inserted with no reactions", got)
+	}
+	if missing, err := s.repo.GetByID(s.ctx, a.ID+1000); err != nil || missing != nil {
+		s.errorf("GetByID of a missing comment: got %v, %v, want nil, nil", missing, err)
+	}
+	b := s.insert("m1", "second", "", nil)
+	c := s.insert("m1", "third", "", nil)
+	pending := s.insert("m1", "pending", data.StatusPending, nil)
+	d := s.insert("m2", "other movie", "", nil)
+	comments, err := s.repo.Fetch(s.ctx, "m1", data.SortNewest)
+	s.must(err, "Fetch")
+	s.expectIDs("Fetch newest", comments, c, b, a)
+	comments, err = s.repo.Fetch(s.ctx, "m1", data.SortOldest)
+	s.must(err, "Fetch")
+	s.expectIDs("Fetch oldest", comments, a, b, c)
+
+	// reactions, upvotes and downvotes cancel out and giving one twice counts once
+	s.must(s.repo.AddReaction(s.ctx, a, "v1", data.ReactionUpvote), "AddReaction")
+	s.must(s.repo.AddReaction(s.ctx, a, "v2", data.ReactionUpvote), "AddReaction")
+	s.must(s.repo.AddReaction(s.ctx, a, "v1", data.ReactionUpvote), "AddReaction")
+	if a.Score != 2 || a.Reactions[data.ReactionUpvote] != 2 {
+		s.errorf("AddReaction: got score %d and reactions %v, want 2 and 2 upvotes", a.Score, a.Reactions)
+	}
+	s.must(s.repo.AddReaction(s.ctx, b, "v1", data.ReactionDownvote), "AddReaction")
+	s.must(s.repo.AddReaction(s.ctx, c, "v1", data.ReactionUpvote), "AddReaction")
+	s.must(s.repo.AddReaction(s.ctx, c, "v1", data.ReactionDownvote), "AddReaction")
+	if c.Score != -1 || c.Reactions[data.ReactionUpvote] != 0 || c.Reactions[data.ReactionDownvote] != 1 {
+		s.errorf("AddReaction of the opposite vote: got score %d and reactions %v, want -1 and a downvote", c.Score, c.Reactions)
+	}
+	s.must(s.repo.RemoveReaction(s.ctx, c, "v1", data.ReactionDownvote), "RemoveReaction")
+	s.must(s.repo.RemoveReaction(s.ctx, c, "v1", data.ReactionDownvote), "RemoveReaction")
+	if c.Score != 0 || len(c.Reactions) != 0 {
+		s.errorf("RemoveReaction: got score %d and reactions %v, want 0 and none", c.Score, c.Reactions)
+	}
+	if got := s.get(a.ID); got.Score != 2 || got.Reactions[data.ReactionUpvote] != 2 {
+		s.errorf("GetByID after AddReaction: got score %d and reactions %v, want 2 and 2 upvotes", got.Score, got.Reactions)
+	}
+	for _, sortBy := range []string{data.SortScore, data.SortHot} {
+		comments, err = s.repo.Fetch(s.ctx, "m1", sortBy)
+		s.must(err, "Fetch")
+		s.expectIDs("Fetch "+sortBy, comments, a, c, b)
+	}
+
+	// keyset pagination both ways, on dates and on scores
+	first := s.page(data.CommentPageQuery{MovieID: "m1", Limit: 2})
+	s.expectIDs("FetchPage first page", first.Comments, c, b)
+	if first.NextCursor == "" || first.PrevCursor != "" {
+		s.errorf("FetchPage first page: got next cursor %q and previous cursor %q, want only a next cursor", first.NextCursor, first.PrevCursor)
+	}
+	last := s.page(data.CommentPageQuery{MovieID: "m1", Limit: 2, After: s.cursor(first.NextCursor)})
+	s.expectIDs("FetchPage last page", last.Comments, a)
+	if last.NextCursor != "" || last.PrevCursor == "" {
+		s.errorf("FetchPage last page: got next cursor %q and previous cursor %q, want only a previous cursor", last.NextCursor, last.PrevCursor)
+	}
+	back := s.page(data.CommentPageQuery{MovieID: "m1", Limit: 2, Before: s.cursor(last.PrevCursor)})
+	s.expectIDs("FetchPage back to the first page", back.Comments, c, b)
+	if back.NextCursor == "" || back.PrevCursor != "" {
+		s.errorf("FetchPage back to the first page: got next cursor %q and previous cursor %q, want only a next cursor", back.NextCursor, back.PrevCursor)
+	}
+	var walked []*data.Comment
+	query := data.CommentPageQuery{MovieID: "m1", Sort: data.SortScore, Limit: 1}
+	for i := 0; i < 5; i++ {
+		page := s.page(query)
+		walked = append(walked, page.Comments...)
+		if page.NextCursor == "" {
+			break
+		}
+		query.After = s.cursor(page.NextCursor)
+	}
+	s.expectIDs("FetchPage by score a comment at a time", walked, a, c, b)
+	if _, err := s.repo.FetchPage(s.ctx, data.CommentPageQuery{MovieID: "m1", Sort: data.SortScore, Limit: 2, After: s.cursor(first.NextCursor)}); !errors.Is(err, data.ErrInvalidCursor) {
+		s.errorf("FetchPage with a cursor of another sort: got %v, want ErrInvalidCursor", err)
+	}
+	s.expectIDs("FetchPage of pending comments", s.page(data.CommentPageQuery{Statuses: []string{data.StatusPending}, Limit: 10}).Comments, pending)
+	s.expectIDs("FetchPage of every movie", s.page(data.CommentPageQuery{Sort: data.SortOldest, Limit: 10}).Comments, a, b, c, d)
+
+	// threads, replies below an unapproved comment are left out with it
+	reply := s.insert("m1", "a reply", "", a)
+	nested := s.insert("m1", "a nested reply", "", reply)
+	hidden := s.insert("m1", "an unapproved reply", data.StatusPending, b)
+	orphan := s.insert("m1", "a reply to an unapproved reply", "", hidden)
+	threads, err := s.repo.FetchThreads(s.ctx, data.CommentPageQuery{MovieID: "m1", Sort: data.SortOldest, Limit: 10})
+	s.must(err, "FetchThreads")
+	roots := make([]*data.Comment, len(threads.Threads))
+	for i, thread := range threads.Threads {
+		roots[i] = thread.Comment
+	}
+	s.expectIDs("FetchThreads", roots, a, b, c)
+	if len(roots) == 3 {
+		if thread := threads.Threads[0]; thread.ReplyCount != 2 || len(thread.Replies) != 1 || thread.Replies[0].ID != reply.ID ||
+			len(thread.Replies[0].Replies) != 1 || thread.Replies[0].Replies[0].ID != nested.ID {
+			s.errorf("FetchThreads: got %d replies nested wrongly below comment %d, want reply %d with reply %d below it", thread.ReplyCount, a.ID, reply.ID, nested.ID)
+		}
+		if thread := threads.Threads[1]; thread.ReplyCount != 0 {
+			s.errorf("FetchThreads: got %d replies below comment %d, want none", thread.ReplyCount, b.ID)
+		}
+	}
+
+	// summaries count every approved comment, replies too
+	summaries, err := s.repo.FetchSummaries(s.ctx, []string{"m1", "m2", "m3"}, 2)
+	s.must(err, "FetchSummaries")
+	if summary := summaries["m1"]; summary == nil || summary.Count != 6 || summary.Top == nil || summary.Top.ID != a.ID {
+		s.errorf("FetchSummaries: got %+v for m1, want 6 comments with %d on top", summary, a.ID)
+	} else {
+		s.expectIDs("FetchSummaries latest", summary.Latest, orphan, nested)
+	}
+	if summary := summaries["m2"]; summary == nil || summary.Count != 1 || summary.Top != nil {
+		s.errorf("FetchSummaries: got %+v for m2, want 1 comment and none on top", summary)
+	}
+	if summary := summaries["m3"]; summary == nil || summary.Count != 0 || summary.Latest == nil || len(summary.Latest) != 0 {
+		s.errorf("FetchSummaries: got %+v for m3, want an empty summary", summary)
+	}
+
+	// updating and deleting
+	edited := s.get(b.ID)
+	edited.Body = "second, edited"
+	s.must(s.repo.Update(s.ctx, edited), "Update")
+	if got := s.get(b.ID); got.Body != "second, edited" || got.UpdatedAt.Before(got.CreatedAt) {
+		s.errorf("Update: got body %q updated at %s, want the edited body", got.Body, got.UpdatedAt)
+	}
+	s.must(s.repo.Delete(s.ctx, edited), "Delete")
+	if got, err := s.repo.GetByID(s.ctx, b.ID); err != nil || got != nil {
+		s.errorf("GetByID of a deleted comment: got %v, %v, want nil, nil", got, err)
+	}
+	if err := s.repo.Update(s.ctx, edited); !errors.Is(err, data.ErrCommentNotFound) {
+		s.errorf("Update of a deleted comment: got %v, want ErrCommentNotFound", err)
+	}
+	if err := s.repo.Delete(s.ctx, edited); !errors.Is(err, data.ErrCommentNotFound) {
+		s.errorf("Delete of a deleted comment: got %v, want ErrCommentNotFound", err)
+	}
+	if err := s.repo.AddReaction(s.ctx, edited, "v9", data.ReactionUpvote); !errors.Is(err, data.ErrCommentNotFound) {
+		s.errorf("AddReaction to a deleted comment: got %v, want ErrCommentNotFound", err)
+	}
+	if err := s.repo.Flag(s.ctx, edited, "f9", "spam", 1); !errors.Is(err, data.ErrCommentNotFound) {
+		s.errorf("Flag of a deleted comment: got %v, want ErrCommentNotFound", err)
+	}
+	comments, err = s.repo.Fetch(s.ctx, "m1", data.SortOldest)
+	s.must(err, "Fetch")
+	s.expectIDs("Fetch after Delete", comments, a, c, reply, nested, orphan)
+
+	// flags and moderation
+	s.must(s.repo.Flag(s.ctx, c, "f1", "spam", 2), "Flag")
+	s.must(s.repo.Flag(s.ctx, c, "f1", "spam", 2), "Flag")
+	if got := s.get(c.ID); got.Status != data.StatusApproved {
+		s.errorf("Flag twice by the same flagger: got status %q, want %q", got.Status, data.StatusApproved)
+	}
+	s.must(s.repo.Flag(s.ctx, c, "f2", "", 2), "Flag")
+	if got := s.get(c.ID); got.Status != data.StatusFlagged || c.Status != data.StatusFlagged {
+		s.errorf("Flag up to the threshold: got status %q, want %q", got.Status, data.StatusFlagged)
+	}
+	s.must(s.repo.Moderate(s.ctx, c, data.StatusApproved), "Moderate")
+	s.must(s.repo.Flag(s.ctx, c, "f3", "", 2), "Flag")
+	if got := s.get(c.ID); got.Status != data.StatusApproved {
+		s.errorf("Flag after approval: got status %q, want %q since approving clears flags", got.Status, data.StatusApproved)
+	}
+
+	// movie ids
+	movieIDs, err := s.repo.MovieIDs(s.ctx)
+	s.must(err, "MovieIDs")
+	sort.Strings(movieIDs)
+	if fmt.Sprint(movieIDs) != "[m1 m2]" {
+		s.errorf("MovieIDs: got %v, want [m1 m2]", movieIDs)
+	}
+	moved, err := s.repo.RemapMovieIDs(s.ctx, map[string]string{"m2": "m4", "m1": "m1"})
+	s.must(err, "RemapMovieIDs")
+	comments, err = s.repo.Fetch(s.ctx, "m4", data.SortNewest)
+	s.must(err, "Fetch")
+	if moved != 1 {
+		s.errorf("RemapMovieIDs: got %d comments moved, want 1", moved)
+	}
+	s.expectIDs("Fetch after RemapMovieIDs", comments, d)
+
+	// ip privacy, every comment counts whatever its status
+	handles, err := s.repo.FillAuthorHandles(s.ctx, func(storedIP string) string { return "anon-" + storedIP })
+	s.must(err, "FillAuthorHandles")
+	if got := s.get(a.ID); handles != 9 || got.AuthorHandle != "anon-"+a.UserPublicIP {
+		s.errorf("FillAuthorHandles: got %d comments and handle %q, want 9 and %q", handles, got.AuthorHandle, "anon-"+a.UserPublicIP)
+	}
+	if handles, err := s.repo.FillAuthorHandles(s.ctx, func(string) string { return "" }); err != nil || handles != 0 {
+		s.errorf("FillAuthorHandles again: got %d, %v, want 0, nil", handles, err)
+	}
+	if purged, err := s.repo.PurgeRawIPs(s.ctx, time.Now().Add(-time.Hour), nil); err != nil || purged != 0 {
+		s.errorf("PurgeRawIPs before any comment: got %d, %v, want 0, nil", purged, err)
+	}
+	purged, err := s.repo.PurgeRawIPs(s.ctx, time.Now().Add(time.Hour), func(ip string) (string, string) { return "hidden", data.IPFormatHMAC })
+	s.must(err, "PurgeRawIPs")
+	if got := s.get(a.ID); purged != 9 || got.UserPublicIP != "hidden" || got.IPFormat != data.IPFormatHMAC {
+		s.errorf("PurgeRawIPs: got %d comments and %q stored as %q, want 9 and %q stored as %q", purged, got.UserPublicIP, got.IPFormat, "hidden", data.IPFormatHMAC)
+	}
+
+	// voters and flaggers stored as addresses are hashed, a client with the same reaction under both keeps one of them
+	s.must(s.repo.AddReaction(s.ctx, a, data.IdentityAnonymousPrefix+"#v2", data.ReactionUpvote), "AddReaction")
+	s.must(s.repo.AddReaction(s.ctx, a, data.IdentityUserPrefix+"1", data.ReactionUpvote), "AddReaction")
+	hashed, err := s.repo.HashAnonymousIdentities(s.ctx, func(stored string) string { return "#" + stored })
+	s.must(err, "HashAnonymousIdentities")
+	if got := s.get(a.ID); hashed != 4 || got.Score != 3 {
+		s.errorf("HashAnonymousIdentities: got %d rows and a score of %d, want 4 and 3", hashed, got.Score)
+	}
+	s.must(s.repo.AddReaction(s.ctx, a, data.IdentityAnonymousPrefix+"#v1", data.ReactionUpvote), "AddReaction")
+	if a.Score != 3 {
+		s.errorf("AddReaction under a hashed identity: got score %d, want 3 since the vote was already there", a.Score)
+	}
+	if hashed, err := s.repo.HashAnonymousIdentities(s.ctx, func(string) string { return "" }); err != nil || hashed != 0 {
+		s.errorf("HashAnonymousIdentities again: got %d, %v, want 0, nil", hashed, err)
+	}
+	s.must(s.repo.RemoveReaction(s.ctx, a, data.IdentityUserPrefix+"1", data.ReactionUpvote), "RemoveReaction")
+
+	// units of work commit together or not at all, nested ones join the outer one
+	err = s.repo.WithTx(s.ctx, func(tx data.CommentRepository) error {
+		if _, err := tx.Insert(s.ctx, &data.Comment{MovieID: "m5", Body: "rolled back", UserPublicIP: "192.0.2.1"}); err != nil {
+			return err
+		}
+		return tx.WithTx(s.ctx, func(nested data.CommentRepository) error {
+			if _, err := nested.Insert(s.ctx, &data.Comment{MovieID: "m5", Body: "rolled back too", UserPublicIP: "192.0.2.1"}); err != nil {
+				return err
+			}
+			return errRollback
+		})
+	})
+	if !errors.Is(err, errRollback) {
+		s.errorf("WithTx: got %v, want the error of the unit of work", err)
+	}
+	comments, err = s.repo.Fetch(s.ctx, "m5", data.SortNewest)
+	s.must(err, "Fetch")
+	s.expectIDs("Fetch after a rolled back WithTx", comments)
+	var committed *data.Comment
+	err = s.repo.WithTx(s.ctx, func(tx data.CommentRepository) error {
+		committed = &data.Comment{MovieID: "m6", Body: "committed", UserPublicIP: "192.0.2.1"}
+		if _, err := tx.Insert(s.ctx, committed); err != nil {
+			return err
+		}
+		return tx.AddReaction(s.ctx, committed, "v1", data.ReactionUpvote)
+	})
+	s.must(err, "WithTx")
+	comments, err = s.repo.Fetch(s.ctx, "m6", data.SortNewest)
+	s.must(err, "Fetch")
+	s.expectIDs("Fetch after a committed WithTx", comments, committed)
+	if len(comments) == 1 && comments[0].Score != 1 {
+		s.errorf("WithTx: got score %d, want 1", comments[0].Score)
+	}
+
+	// signed in authors go by their username, which can be 50 characters long
+	handle := strings.Repeat("u", 50)
+	long := &data.Comment{MovieID: "m7", Body: "a long handle", UserPublicIP: "192.0.2.1", AuthorHandle: handle}
+	_, err = s.repo.Insert(s.ctx, long)
+	s.must(err, "Insert with a 50 character author handle")
+	if got := s.get(long.ID); got.AuthorHandle != handle {
+		s.errorf("GetByID: got author handle %q, want %q", got.AuthorHandle, handle)
+	}
+}
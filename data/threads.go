@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"fmt"
+)
+
+// CommentThread is a comment with its replies nested under it, ReplyCount counts every reply below it however deep
+type CommentThread struct {
+	*Comment
+	ReplyCount int              `json:"reply_count"`
+	Replies    []*CommentThread `json:"replies"`
+}
+
+type ThreadPage struct {
+	Threads    []*CommentThread `json:"threads"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+	PrevCursor string           `json:"prev_cursor,omitempty"`
+}
+
+/*
+fetch a page of top level comments for a movie with all of their replies nested under them.
+pagination works on the top level comments only, replies are ordered oldest first so threads read like a conversation.
+replies to a deleted or unapproved comment are left out along with it
+*/
+func (r *SQLCommentRepository) FetchThreads(ctx context.Context, query CommentPageQuery) (*ThreadPage, error) {
+	query.RootsOnly = true
+	page, err := r.FetchPage(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	rootIDs := make([]int64, 0, len(page.Comments))
+	for _, comment := range page.Comments {
+		rootIDs = append(rootIDs, int64(comment.ID))
+	}
+
+	replies, err := r.fetchReplies(ctx, rootIDs)
+	if err != nil {
+		return nil, err
+	}
+	return newThreadPage(page, replies), nil
+}
+
+// newThreadPage nests replies, every approved reply below the comments of page oldest first, under the comments they reply to
+func newThreadPage(page *CommentPage, replies []*Comment) *ThreadPage {
+	threads := make([]*CommentThread, 0, len(page.Comments))
+	nodes := make(map[int]*CommentThread, len(page.Comments))
+	for _, comment := range page.Comments {
+		thread := &CommentThread{Comment: comment, Replies: []*CommentThread{}}
+		threads = append(threads, thread)
+		nodes[comment.ID] = thread
+	}
+	// a reply always comes after its parent, so the parent is in nodes by the time the reply is reached
+	for _, reply := range replies {
+		parent, ok := nodes[*reply.ParentID]
+		if !ok {
+			continue
+		}
+		thread := &CommentThread{Comment: reply, Replies: []*CommentThread{}}
+		parent.Replies = append(parent.Replies, thread)
+		nodes[reply.ID] = thread
+	}
+	for _, thread := range threads {
+		countReplies(thread)
+	}
+
+	return &ThreadPage{
+		Threads:    threads,
+		NextCursor: page.NextCursor,
+		PrevCursor: page.PrevCursor,
+	}
+}
+
+// fetchReplies returns every approved reply below the given comments, oldest first
+func (r *SQLCommentRepository) fetchReplies(ctx context.Context, parentIDs []int64) ([]*Comment, error) {
+	if len(parentIDs) == 0 {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	args := []interface{}{StatusApproved}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	query := `WITH RECURSIVE replies AS (
+			SELECT ` + commentColumns + ` FROM comments WHERE ` + r.dialect.oneOf("parent_id", parentIDs, arg) + ` AND deleted_at IS NULL AND status = $1
+			UNION ALL
+			SELECT c.id, c.movie_id, c.parent_id, c.depth, c.body, c.user_public_ip, c.ip_format, c.author_key, c.user_id, c.author_handle, c.status, c.score, c.reactions, c.created_at, c.updated_at
+			FROM comments c JOIN replies r ON c.parent_id = r.id WHERE c.deleted_at IS NULL AND c.status = $1
+		)
+		SELECT ` + commentColumns + ` FROM replies ORDER BY created_at, id`
+	rows, err := r.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var replies []*Comment
+	for rows.Next() {
+		reply, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, rows.Err()
+}
+
+func countReplies(thread *CommentThread) int {
+	thread.ReplyCount = 0
+	for _, reply := range thread.Replies {
+		thread.ReplyCount += 1 + countReplies(reply)
+	}
+	return thread.ReplyCount
+}
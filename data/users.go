@@ -0,0 +1,85 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrUsernameTaken = errors.New("username is already taken")
+
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	// what the user is allowed to do, one of the roles of the app package
+	Role         string    `json:"role"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// UserRepository stores accounts
+type UserRepository struct {
+	db      *sql.DB
+	dialect *sqlDialect
+}
+
+func NewUserRepository(db *sql.DB) *UserRepository {
+	return &UserRepository{db: db, dialect: postgresDialect}
+}
+
+const userColumns = `id, username, role, password_hash, created_at, updated_at`
+
+/*
+create a new user, returns ErrUsernameTaken when another user already has the username
+*/
+func (r *UserRepository) Insert(ctx context.Context, u *User) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	now := r.dialect.timeArg(time.Now())
+	query := `INSERT INTO users (username, role, password_hash, created_at, updated_at) VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	if err := r.db.QueryRowContext(ctx, query, u.Username, u.Role, u.PasswordHash, now, now).Scan(&u.ID); err != nil {
+		if r.dialect.uniqueViolation(err) {
+			return 0, ErrUsernameTaken
+		}
+		return 0, err
+	}
+	u.CreatedAt, u.UpdatedAt = now, now
+	return u.ID, nil
+}
+
+/*
+fetch a user by username, usernames are matched case insensitively. returns nil if there is no such user
+*/
+func (r *UserRepository) GetByUsername(ctx context.Context, username string) (*User, error) {
+	return r.get(ctx, `SELECT `+userColumns+` FROM users WHERE LOWER(username) = LOWER($1)`, username)
+}
+
+/*
+fetch a user by id, returns nil if there is no such user
+*/
+func (r *UserRepository) GetByID(ctx context.Context, id int) (*User, error) {
+	return r.get(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id)
+}
+
+/*
+change the role of the user with id, returns nil if there is no such user
+*/
+func (r *UserRepository) SetRole(ctx context.Context, id int, role string) (*User, error) {
+	return r.get(ctx, `UPDATE users SET role = $2, updated_at = $3 WHERE id = $1 RETURNING `+userColumns, id, role, r.dialect.timeArg(time.Now()))
+}
+
+func (r *UserRepository) get(ctx context.Context, query string, args ...interface{}) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+	var user User
+	err := r.db.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.Username, &user.Role, &user.PasswordHash, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &user, nil
+}
@@ -1,38 +1,131 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v8"
 	"github.com/showbaba/movies-api/app"
 	"github.com/showbaba/movies-api/data"
 	"github.com/showbaba/movies-api/utils"
 )
 
 func main() {
-	// open connection to redis
-	redisCLient := redis.NewClient(&redis.Options{
-		Addr: app.GetConfig().RedisURL,
-	})
-	defer redisCLient.Close()
-	// test redis connection
-	_, err := redisCLient.Ping().Result()
+	migrateMovieIDs := flag.Bool("migrate-movie-ids", false, "move cached movies and comments over to canonical movie ids, then exit")
+	migrate := flag.String("migrate", "", "run a schema migration operation (up, down, status or redo), then exit")
+	steps := flag.Int("steps", 1, "how many migrations -migrate down reverts")
+	flag.Parse()
+
+	data.SetQueryTimeout(app.GetConfig().DbTimeout)
+	if *migrate != "" {
+		// the sqlite stores migrate themselves when they are opened, so migrations are run by hand on postgres only
+		dbConn := utils.ConnectToSQLDB(
+			app.GetConfig().DbHost,
+			app.GetConfig().DbUser,
+			app.GetConfig().DbPassword,
+			app.GetConfig().DbName,
+			app.GetConfig().DbPort,
+		)
+		defer dbConn.Close()
+		if err := runMigrate(dbConn, *migrate, *steps); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	models, dbConn, err := app.OpenModels(app.GetConfig())
 	if err != nil {
 		panic(err)
 	}
-	dbConn := utils.ConnectToSQLDB(
-		app.GetConfig().DbHost,
-		app.GetConfig().DbUser,
-		app.GetConfig().DbPassword,
-		app.GetConfig().DbName,
-		app.GetConfig().DbPort,
-	)
 	defer dbConn.Close()
-	models := data.New(dbConn)
-	data.Migrate()
+
+	var redisCLient *redis.Client
+	if app.GetConfig().CacheBackend != "memory" {
+		// open connection to redis
+		redisCLient = redis.NewClient(&redis.Options{
+			Addr:         app.GetConfig().RedisURL,
+			DialTimeout:  app.GetConfig().RedisTimeout,
+			ReadTimeout:  app.GetConfig().RedisTimeout,
+			WriteTimeout: app.GetConfig().RedisTimeout,
+		})
+		defer redisCLient.Close()
+		// test redis connection
+		_, err := redisCLient.Ping(context.Background()).Result()
+		if err != nil {
+			panic(err)
+		}
+	}
+	cache, err := app.NewCache(app.GetConfig(), redisCLient)
+	if err != nil {
+		panic(err)
+	}
 	server := app.App{}
 	port := app.GetConfig().Port
-	server.Initialize(&models, redisCLient)
+	provider, err := app.NewMovieProvider(app.GetConfig(), &http.Client{Transport: app.NewUpstreamTransport(app.GetConfig(), nil)})
+	if err != nil {
+		panic(err)
+	}
+	limiter, err := app.NewRateLimiter(app.GetConfig(), redisCLient)
+	if err != nil {
+		panic(err)
+	}
+	privacy, err := app.NewIPPrivacy(app.GetConfig())
+	if err != nil {
+		panic(err)
+	}
+	server.Initialize(&models, cache, provider, limiter, privacy)
+	if *migrateMovieIDs {
+		if err := app.MigrateMovieIDs(context.Background(), redisCLient); err != nil {
+			panic(err)
+		}
+		return
+	}
+	app.StartIPRetention()
 	log.Printf("talk to me Lord your server is listening on port %s 🙏 ", port)
 	server.Run(port)
 }
+
+// runMigrate runs one of the -migrate operations
+func runMigrate(db *sql.DB, operation string, steps int) error {
+	switch operation {
+	case "up":
+		applied, err := data.MigrateUp(db)
+		if err == nil && len(applied) == 0 {
+			log.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		if steps < 1 {
+			return fmt.Errorf("-steps must be at least 1")
+		}
+		reverted, err := data.MigrateDown(db, steps)
+		if err == nil && len(reverted) == 0 {
+			log.Println("no migration to revert")
+		}
+		return err
+	case "redo":
+		redone, err := data.MigrateRedo(db)
+		if err == nil && redone == nil {
+			log.Println("no migration to redo")
+		}
+		return err
+	case "status":
+		statuses, err := data.FetchMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%-40s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate operation %q, expected up, down, status or redo", operation)
+}
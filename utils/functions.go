@@ -4,9 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math"
+	"net"
 	"net/http"
 
 	_ "github.com/lib/pq"
@@ -56,27 +58,42 @@ func WriteInfo(format string, args ...interface{}) []byte {
 	return nil
 }
 
-// check if a table exist in the pg db
-func CheckTableExist(ctx context.Context, db *sql.DB, tableName string) (bool, error) {
-	query := `
-		SELECT EXISTS (
-   SELECT FROM pg_tables
-   WHERE  schemaname = 'public'
-   AND    tablename  = $1
-   );
-	`
-	row := db.QueryRowContext(ctx, query, tableName)
-	var response bool
-	_ = row.Scan(&response)
-	return response, nil
-}
-
 // 500 - internal server error
 func Dispatch500Error(w http.ResponseWriter, err error) {
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Write(WriteError(http.StatusInternalServerError, "", fmt.Sprintf("%v", err)))
 }
 
+// 503 - service unavailable
+func Dispatch503Error(w http.ResponseWriter, msg string, err any) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(WriteError(http.StatusServiceUnavailable, msg, err))
+}
+
+// 504 - gateway timeout
+func Dispatch504Error(w http.ResponseWriter, msg string, err any) {
+	w.WriteHeader(http.StatusGatewayTimeout)
+	w.Write(WriteError(http.StatusGatewayTimeout, msg, err))
+}
+
+// DispatchServerError answers 504 when err is a dependency running out of time, 500 otherwise
+func DispatchServerError(w http.ResponseWriter, err error) {
+	if IsTimeout(err) {
+		Dispatch504Error(w, "a dependency took too long to respond", fmt.Sprintf("%v", err))
+		return
+	}
+	Dispatch500Error(w, err)
+}
+
+// IsTimeout reports whether err comes from a deadline running out, either a context's or a network call's
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
 // 501 - not implemented
 func Dispatch501Error(w http.ResponseWriter, msg string, err error) {
 	w.WriteHeader(http.StatusNotImplemented)
@@ -95,12 +112,36 @@ func Dispatch400Error(w http.ResponseWriter, msg string, err any) {
 	w.Write(WriteError(http.StatusBadRequest, msg, err))
 }
 
+// 401 - unauthorized
+func Dispatch401Error(w http.ResponseWriter, msg string, err any) {
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(WriteError(http.StatusUnauthorized, msg, err))
+}
+
+// 403 - forbidden
+func Dispatch403Error(w http.ResponseWriter, msg string, err any) {
+	w.WriteHeader(http.StatusForbidden)
+	w.Write(WriteError(http.StatusForbidden, msg, err))
+}
+
 // 404 - not found
 func Dispatch404Error(w http.ResponseWriter, msg string, err any) {
 	w.WriteHeader(http.StatusNotFound)
 	w.Write(WriteError(http.StatusNotFound, msg, err))
 }
 
+// 409 - conflict
+func Dispatch409Error(w http.ResponseWriter, msg string, err any) {
+	w.WriteHeader(http.StatusConflict)
+	w.Write(WriteError(http.StatusConflict, msg, err))
+}
+
+// 429 - too many requests
+func Dispatch429Error(w http.ResponseWriter, msg string, err any) {
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write(WriteError(http.StatusTooManyRequests, msg, err))
+}
+
 func CmToFeetInches(cm float64) string {
 	feet := int(cm / 30.48)
 	inches := (cm / 30.48) - float64(feet)